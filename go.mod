@@ -1,7 +1,11 @@
 module github.com/ostcar/mailimage
 
+go 1.16
+
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/disintegration/imaging v1.6.0
+	github.com/emersion/go-msgauth v0.6.6
 	github.com/gomodule/redigo v2.0.0+incompatible
 	github.com/jaytaylor/html2text v0.0.0-20190408195923-01ec452cbe43 // indirect
 	github.com/jhillyerd/enmime v0.5.0
@@ -10,8 +14,8 @@ require (
 	github.com/pkg/errors v0.8.1 // indirect
 	github.com/urfave/cli v1.20.0
 	golang.org/x/image v0.0.0-20190516052701-61b8692d9a5c // indirect
-	golang.org/x/net v0.0.0-20190514140710-3ec191127204 // indirect
-	golang.org/x/text v0.3.2 // indirect
+	golang.org/x/net v0.0.0-20190514140710-3ec191127204
+	golang.org/x/text v0.3.2
 	golang.org/x/xerrors v0.0.0-20190513163551-3ee3066db522
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/mail.v2 v2.3.1
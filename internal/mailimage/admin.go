@@ -0,0 +1,91 @@
+package mailimage
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/xerrors"
+)
+
+// adminPage is a handler of an admin page of a board. The browser asks for the
+// admin token with basic auth, the user name is ignored. Errors are shown with
+// the error page of the board.
+type adminPage errHandler
+
+func (a adminPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, token, _ := r.BasicAuth(); !validAdminToken(token) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mailimage admin", charset="UTF-8"`)
+		http.Error(w, "invalid admin token", http.StatusUnauthorized)
+		return
+	}
+
+	// The browser sends the credentials with every request, so forms from
+	// other sites could use them.
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+
+	errHandler(a).ServeHTTP(w, r)
+}
+
+// sameOrigin returns false, if the browser tells, that the request comes from
+// another site. Requests without the headers are not from a browser.
+func sameOrigin(r *http.Request) bool {
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "same-origin", "none":
+		return true
+	case "":
+	default:
+		return false
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// trash shows the entries in the trash with a form to restore each of them.
+func (h *handler) trash(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		return errMethodNotAllowed
+	}
+
+	entries, err := h.redis.trashedEntries()
+	if err != nil {
+		return err
+	}
+
+	data := h.redis.newPageData(w, r)
+	data.Trash = entries
+	if err := h.redis.getTemplates().trash.Execute(w, data); err != nil {
+		return xerrors.Errorf("can not execute trash html template: %w", err)
+	}
+	return nil
+}
+
+// restore moves an entry out of the trash and returns to the trash page.
+func (h *handler) restore(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return errMethodNotAllowed
+	}
+
+	id, err := strconv.Atoi(r.URL.Path[len("/admin/trash/"):])
+	if err != nil {
+		return errUnknownImage
+	}
+
+	if err := h.redis.restoreFromTrash(id); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, h.redis.baseURL+"/admin/trash", http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,75 @@
+package mailimage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAdminTrashPage(t *testing.T) {
+	p := setupTest(t, "admin_token = \"secret\"\n"+trashConfigTOML)
+	id := insertTestEntry(t, p)
+	handler := newBoardHandler(p)
+
+	if err := p.trashEntry(id); err != nil {
+		t.Fatalf("trashEntry returned error: %v", err)
+	}
+
+	request := func(method, path, password string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if password != "" {
+			r.SetBasicAuth("admin", password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	if rec := request("GET", "/admin/trash", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("trash page with wrong token returned status %d", rec.Code)
+	}
+
+	rec := request("GET", "/admin/trash", "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("trash page returned status %d", rec.Code)
+	}
+	if action := `action="trash/` + strconv.Itoa(id) + `"`; !strings.Contains(rec.Body.String(), action) {
+		t.Errorf("trash page has no form with %s:\n%s", action, rec.Body.String())
+	}
+
+	if rec := request("GET", "/admin/trash/"+strconv.Itoa(id), "secret"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("restore with GET returned status %d", rec.Code)
+	}
+
+	if rec := request("POST", "/admin/trash/"+strconv.Itoa(id), "secret"); rec.Code != http.StatusSeeOther {
+		t.Errorf("restore returned status %d", rec.Code)
+	}
+	if _, err := p.getEntry(id); err != nil {
+		t.Errorf("entry was not restored: %v", err)
+	}
+}
+
+func TestAdminPageRejectsCrossOrigin(t *testing.T) {
+	p := setupTest(t, "admin_token = \"secret\"\n"+trashConfigTOML)
+	id := insertTestEntry(t, p)
+	handler := newBoardHandler(p)
+
+	if err := p.trashEntry(id); err != nil {
+		t.Fatalf("trashEntry returned error: %v", err)
+	}
+
+	r := httptest.NewRequest("POST", "/admin/trash/"+strconv.Itoa(id), nil)
+	r.SetBasicAuth("admin", "secret")
+	r.Header.Set("Origin", "https://other.example")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("cross-origin restore returned status %d, expected %d", rec.Code, http.StatusForbidden)
+	}
+	if _, err := p.getEntry(id); err != errUnknownImage {
+		t.Errorf("entry was restored by a cross-origin request: %v", err)
+	}
+}
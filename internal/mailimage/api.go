@@ -0,0 +1,168 @@
+package mailimage
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/xerrors"
+)
+
+// adminHandler is a handler of the admin api. It checks the admin token and
+// writes errors as json.
+type adminHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (f adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !validAdminToken(token) {
+		writeJSON(w, http.StatusUnauthorized, apiError{"invalid admin token"})
+		return
+	}
+
+	if err := f(w, r); err != nil {
+		status := http.StatusInternalServerError
+		message := "internal error"
+
+		var uerr *userError
+		var rerr requestError
+		switch {
+		case err == errUnknownImage:
+			status = http.StatusNotFound
+			message = err.Error()
+		case xerrors.As(err, &uerr):
+			status = http.StatusBadRequest
+			message = uerr.Error()
+		case xerrors.As(err, &rerr):
+			status = http.StatusBadRequest
+			message = rerr.Error()
+		default:
+			log.Printf("Error: %v", err)
+		}
+		writeJSON(w, status, apiError{message})
+	}
+}
+
+// validAdminToken returns true, if the token is the admin token from the
+// config. Without an admin token in the config, no token is valid.
+func validAdminToken(token string) bool {
+	return cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1
+}
+
+// apiError is the response of the admin api, if an error happens.
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// requestError is an error in a request to the admin api.
+type requestError struct {
+	error
+}
+
+// writeJSON writes a json response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Can not write json response: %v", err)
+	}
+}
+
+// apiEntry returns an entry with its edit history. With the methods PATCH or
+// POST, the entry is changed first. DELETE moves the entry into the trash.
+func (h *handler) apiEntry(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.URL.Path[len("/api/entry/"):])
+	if err != nil {
+		return errUnknownImage
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPatch, http.MethodPost:
+		var u EntryUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			return requestError{xerrors.Errorf("invalid json: %w", err)}
+		}
+
+		if err := u.validate(); err != nil {
+			return requestError{err}
+		}
+
+		if err := h.redis.updateEntry(id, u); err != nil {
+			return err
+		}
+
+	case http.MethodDelete:
+		if err := h.redis.trashEntry(id); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	default:
+		w.Header().Set("Allow", "GET, PATCH, POST, DELETE")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+		return nil
+	}
+
+	e, err := h.redis.getEntry(id)
+	if err != nil {
+		return err
+	}
+
+	history, err := h.redis.entryHistory(id)
+	if err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		ID      int         `json:"id"`
+		From    string      `json:"from"`
+		Subject string      `json:"subject"`
+		Text    string      `json:"text"`
+		Created string      `json:"created"`
+		History []entryEdit `json:"history"`
+	}{e.ID, e.From, e.Subject, e.Text, e.Created, history})
+	return nil
+}
+
+// apiTrash returns the entries in the trash.
+func (h *handler) apiTrash(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+		return nil
+	}
+
+	entries, err := h.redis.trashedEntries()
+	if err != nil {
+		return err
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+	return nil
+}
+
+// apiRestore moves an entry out of the trash.
+func (h *handler) apiRestore(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+		return nil
+	}
+
+	id, err := strconv.Atoi(r.URL.Path[len("/api/restore/"):])
+	if err != nil {
+		return errUnknownImage
+	}
+
+	if err := h.redis.restoreFromTrash(id); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
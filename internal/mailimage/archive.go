@@ -0,0 +1,461 @@
+package mailimage
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// archiveVersion is the version of the archive format.
+const archiveVersion = 1
+
+// manifest describes the content of an archive. It is the first file in the
+// archive.
+type manifest struct {
+	Version int             `json:"version"`
+	Created time.Time       `json:"created"`
+	Entries []archivedEntry `json:"entries"`
+}
+
+// archivedEntry is an entry in an archive.
+type archivedEntry struct {
+	ID      int               `json:"id"`
+	Fields  map[string]string `json:"fields"`
+	History []entryEdit       `json:"history"`
+
+	// TokenTTL is the remaining lifetime of the delete token in seconds. It is
+	// 0, if the token expired.
+	TokenTTL int `json:"token_ttl"`
+
+	Files []archivedFile `json:"files"`
+}
+
+// archivedFile is a file in an archive.
+type archivedFile struct {
+	// Kind is "image" or "mail".
+	Kind   string `json:"kind"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// entryFiles returns the names of the files of an entry in the store and their
+// names in the archive by their kind.
+func entryFiles(e entry) map[string][2]string {
+	return map[string][2]string{
+		"image": {e.imageName(), path.Join("images", fmt.Sprintf("%d%s", e.ID, e.Extension))},
+		"mail":  {path.Join("success", strconv.Itoa(e.ID)), path.Join("mails", strconv.Itoa(e.ID))},
+	}
+}
+
+// fileChecksum returns the size and the sha256 hash of a file in the store.
+func (b *board) fileChecksum(name string) (int64, string, error) {
+	f, err := b.store.open(name)
+	if err != nil {
+		return 0, "", xerrors.Errorf("can not open %s: %w", name, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", xerrors.Errorf("can not read %s: %w", name, err)
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Export writes all entries with their images and mails into a tar.gz archive.
+func Export(w io.Writer, archive string) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	entries, err := pool.listEntries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	m := manifest{Version: archiveVersion, Created: time.Now()}
+	sources := make(map[string]string)
+	conn := pool.Get()
+	defer conn.Close()
+
+	for _, e := range entries {
+		fields, err := redis.StringMap(conn.Do("HGETALL", pool.key("entry", strconv.Itoa(e.ID))))
+		if err != nil {
+			return xerrors.Errorf("can not receive entry %d: %w", e.ID, err)
+		}
+
+		history, err := pool.entryHistory(e.ID)
+		if err != nil {
+			return err
+		}
+
+		a := archivedEntry{ID: e.ID, Fields: fields, History: history}
+		if token := fields["deletetoken"]; token != "" {
+			ttl, err := redis.Int(conn.Do("TTL", pool.key("deletetoken", token)))
+			if err != nil {
+				return xerrors.Errorf("can not receive delete token: %w", err)
+			}
+			if ttl > 0 {
+				a.TokenTTL = ttl
+			}
+		}
+
+		for _, kind := range []string{"image", "mail"} {
+			file := entryFiles(e)[kind]
+			source, name := file[0], file[1]
+			size, sum, err := pool.fileChecksum(source)
+			if os.IsNotExist(xerrors.Unwrap(err)) && kind == "mail" {
+				fmt.Fprintf(w, "entry %d: mail file is missing\n", e.ID)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			sources[name] = source
+			a.Files = append(a.Files, archivedFile{Kind: kind, Path: name, Size: size, SHA256: sum})
+		}
+		m.Entries = append(m.Entries, a)
+	}
+
+	f, err := os.Create(archive)
+	if err != nil {
+		return xerrors.Errorf("can not create archive: %w", err)
+	}
+	defer f.Close()
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("can not encode manifest: %w", err)
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(data)), ModTime: m.Created}); err != nil {
+		return xerrors.Errorf("can not write manifest: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return xerrors.Errorf("can not write manifest: %w", err)
+	}
+
+	for _, e := range m.Entries {
+		for _, file := range e.Files {
+			if err := pool.addArchiveFile(tw, file, sources[file.Path]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return xerrors.Errorf("can not write archive: %w", err)
+	}
+	if err := gw.Close(); err != nil {
+		return xerrors.Errorf("can not write archive: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return xerrors.Errorf("can not write archive: %w", err)
+	}
+
+	fmt.Fprintf(w, "%d entries exported to %s\n", len(m.Entries), archive)
+	return nil
+}
+
+// addArchiveFile writes one file from the store into an archive.
+func (b *board) addArchiveFile(tw *tar.Writer, file archivedFile, source string) error {
+	f, err := b.store.open(source)
+	if err != nil {
+		return xerrors.Errorf("can not open %s: %w", source, err)
+	}
+	defer f.Close()
+
+	if err := tw.WriteHeader(&tar.Header{Name: file.Path, Mode: 0644, Size: file.Size, ModTime: time.Now()}); err != nil {
+		return xerrors.Errorf("can not write %s: %w", file.Path, err)
+	}
+
+	if _, err := io.CopyN(tw, f, file.Size); err != nil {
+		return xerrors.Errorf("can not write %s: %w", file.Path, err)
+	}
+	return nil
+}
+
+// Import restores the entries from an archive that was created by Export. If
+// preserveIDs is true, the entries keep their ids and the import fails, if an
+// id is already used. Otherwise, the entries get new ids.
+//
+// The checksums of all files are verified, before anything is imported.
+func Import(w io.Writer, archive string, preserveIDs bool) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	tmp, err := ioutil.TempDir("", "mailimage-import")
+	if err != nil {
+		return xerrors.Errorf("can not create temporary folder: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	m, err := extractArchive(archive, tmp)
+	if err != nil {
+		return err
+	}
+
+	if preserveIDs {
+		for _, e := range m.Entries {
+			exists, err := pool.entryExists(e.ID)
+			if err != nil {
+				return err
+			}
+
+			if exists {
+				return xerrors.Errorf("entry %d already exists", e.ID)
+			}
+		}
+	}
+
+	for _, e := range m.Entries {
+		id := e.ID
+		if !preserveIDs {
+			if id, err = pool.getNewID(); err != nil {
+				return err
+			}
+		}
+
+		if err := pool.restoreEntry(id, e, tmp); err != nil {
+			return xerrors.Errorf("can not import entry %d: %w", e.ID, err)
+		}
+		fmt.Fprintf(w, "entry %d imported as %d\n", e.ID, id)
+	}
+	return nil
+}
+
+// extractArchive extracts all files of an archive into a folder and verifies
+// them with the checksums from the manifest.
+func extractArchive(archive, folder string) (manifest, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return manifest{}, xerrors.Errorf("can not open archive: %w", err)
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest{}, xerrors.Errorf("can not read archive: %w", err)
+	}
+	tr := tar.NewReader(gr)
+
+	var m manifest
+	sums := make(map[string]string)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest{}, xerrors.Errorf("can not read archive: %w", err)
+		}
+
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&m); err != nil {
+				return manifest{}, xerrors.Errorf("can not decode manifest: %w", err)
+			}
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || len(name) > 2 && name[:3] == "../" {
+			return manifest{}, xerrors.Errorf("invalid file name in archive: %s", header.Name)
+		}
+
+		target := filepath.Join(folder, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return manifest{}, xerrors.Errorf("can not create folder: %w", err)
+		}
+
+		out, err := os.Create(target)
+		if err != nil {
+			return manifest{}, xerrors.Errorf("can not extract %s: %w", name, err)
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, h), tr)
+		out.Close()
+		if err != nil {
+			return manifest{}, xerrors.Errorf("can not extract %s: %w", name, err)
+		}
+		sums[name] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	if m.Version != archiveVersion {
+		return manifest{}, xerrors.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	for _, e := range m.Entries {
+		if e.Fields["fileext"] == "" {
+			return manifest{}, xerrors.Errorf("entry %d has no image", e.ID)
+		}
+
+		for _, file := range e.Files {
+			sum, ok := sums[path.Clean(file.Path)]
+			if !ok {
+				return manifest{}, xerrors.Errorf("file %s of entry %d is missing", file.Path, e.ID)
+			}
+			if sum != file.SHA256 {
+				return manifest{}, xerrors.Errorf("checksum of %s does not match", file.Path)
+			}
+		}
+	}
+	return m, nil
+}
+
+// restoreEntry saves an entry from an archive with the given id. The files of
+// the entry are read from the extracted archive in folder. The image is saved
+// into the blob store.
+func (p *pool) restoreEntry(id int, e archivedEntry, folder string) error {
+	// Archives of older versions contain times in the legacy format
+	if _, err := upgradeTimeFields(e.Fields); err != nil {
+		return err
+	}
+
+	created, err := parseTime(e.Fields["created"])
+	if err != nil {
+		return xerrors.Errorf("can not parse created time: %w", err)
+	}
+
+	var image, mail []byte
+	for _, file := range e.Files {
+		data, err := ioutil.ReadFile(filepath.Join(folder, filepath.FromSlash(file.Path)))
+		if err != nil {
+			return xerrors.Errorf("can not read %s: %w", file.Path, err)
+		}
+
+		switch file.Kind {
+		case "image":
+			image = data
+
+		case "mail":
+			mail = data
+
+		default:
+			return xerrors.Errorf("unknown file kind %s", file.Kind)
+		}
+	}
+
+	if image == nil {
+		return xerrors.New("the archive contains no image")
+	}
+
+	history := make([][]byte, 0, len(e.History))
+	for _, edit := range e.History {
+		data, err := json.Marshal(edit)
+		if err != nil {
+			return xerrors.Errorf("can not encode history: %w", err)
+		}
+		history = append(history, data)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	// Make sure, that new entries do not get the id of an imported entry. This
+	// happens before the entry is written, so an insert at the same time can
+	// not get the id.
+	if _, err := raiseIDScript.Do(conn, p.key("last_id"), id); err != nil {
+		return xerrors.Errorf("can not set last id: %w", err)
+	}
+
+	// A token that is used by another entry is not restored
+	token := e.Fields["deletetoken"]
+	if token != "" {
+		exists, err := redis.Bool(conn.Do("EXISTS", p.key("deletetoken", token)))
+		if err != nil {
+			return xerrors.Errorf("can not check delete token: %w", err)
+		}
+		if exists {
+			token = ""
+		}
+	}
+
+	// The blob is linked before it is stored, so it can not be removed in
+	// between.
+	if err := p.linkBlob(id, blobHash(image)); err != nil {
+		return err
+	}
+	if _, err := p.storeBlob(image); err != nil {
+		p.undoLinkBlob(id)
+		return err
+	}
+
+	target := path.Join("success", strconv.Itoa(id))
+	if mail != nil {
+		if err := p.store.write(target, mail); err != nil {
+			p.undoLinkBlob(id)
+			return xerrors.Errorf("can not write %s: %w", target, err)
+		}
+	}
+
+	args := []interface{}{p.key("entry", strconv.Itoa(id))}
+	for field, value := range e.Fields {
+		if (field == "deletetoken" && token == "") || field == "blob" {
+			continue
+		}
+		args = append(args, field, value)
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", args...)
+	for _, data := range history {
+		conn.Send("RPUSH", p.key("entry", strconv.Itoa(id), "history"), data)
+	}
+	if token != "" && e.TokenTTL > 0 {
+		conn.Send("SET", p.key("deletetoken", token), id, "EX", e.TokenTTL)
+	}
+	conn.Send("ZADD", p.key("entries"), created.Unix(), id)
+	conn.Send("INCR", p.generationKey())
+	if _, err := conn.Do("EXEC"); err != nil {
+		p.undoLinkBlob(id)
+		if mail != nil {
+			if removeErr := p.store.remove(target); removeErr != nil {
+				log.Printf("Can not remove %s: %v", target, removeErr)
+			}
+		}
+		return xerrors.Errorf("can not save entry: %w", err)
+	}
+	return nil
+}
+
+// raiseIDScript sets the last id to an id, if it is smaller.
+//
+// KEYS: last id key
+// ARGV: id
+var raiseIDScript = redis.NewScript(1, `
+local last = tonumber(redis.call("GET", KEYS[1]) or "0")
+if last < tonumber(ARGV[1]) then
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return last
+`)
@@ -0,0 +1,105 @@
+package mailimage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// testArchivedEntry writes the files of an archived entry into folder and
+// returns the entry. The image is only added, if withImage is true.
+func testArchivedEntry(t testing.TB, folder string, withImage bool) archivedEntry {
+	t.Helper()
+
+	files := map[string][]byte{"mail.eml": testMail(t, "user@example.org", "")}
+	if withImage {
+		files["image.png"] = testImage(t)
+	}
+
+	e := archivedEntry{
+		Fields: map[string]string{
+			"from":    "user@example.org",
+			"subject": "Kohl",
+			"fileext": ".png",
+			"created": formatTime(time.Date(2019, 5, 19, 22, 17, 1, 0, time.UTC)),
+		},
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(folder, name), data, 0644); err != nil {
+			t.Fatalf("can not write %s: %v", name, err)
+		}
+
+		kind := "mail"
+		if name == "image.png" {
+			kind = "image"
+		}
+		e.Files = append(e.Files, archivedFile{Kind: kind, Path: name})
+	}
+	return e
+}
+
+func TestRestoreEntryRaisesLastID(t *testing.T) {
+	p := setupTest(t, "")
+	folder := t.TempDir()
+	e := testArchivedEntry(t, folder, true)
+
+	for _, id := range []int{10, 5} {
+		if err := p.restoreEntry(id, e, folder); err != nil {
+			t.Fatalf("restoreEntry %d returned error: %v", id, err)
+		}
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+	lastID, err := redis.Int(conn.Do("GET", p.key("last_id")))
+	if err != nil {
+		t.Fatalf("can not receive last id: %v", err)
+	}
+	if lastID != 10 {
+		t.Errorf("last id is %d, expected 10", lastID)
+	}
+
+	if _, err := p.store.stat("success/10"); err != nil {
+		t.Errorf("mail of restored entry is missing: %v", err)
+	}
+}
+
+func TestRestoreEntryFailureKeepsNoMail(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		image bool
+		block string
+	}{
+		{name: "no image"},
+		{name: "blob store fails", image: true, block: "blobs"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := setupTest(t, "")
+			folder := t.TempDir()
+			e := testArchivedEntry(t, folder, tt.image)
+
+			if tt.block != "" {
+				// A file with the name of the folder lets the write fail.
+				if err := p.store.write(tt.block, nil); err != nil {
+					t.Fatalf("can not block %s: %v", tt.block, err)
+				}
+			}
+
+			if err := p.restoreEntry(3, e, folder); err == nil {
+				t.Fatalf("restoreEntry returned no error")
+			}
+
+			if _, err := p.store.stat("success/" + strconv.Itoa(3)); !os.IsNotExist(err) {
+				t.Errorf("mail of failed import exists: %v", err)
+			}
+			if exists, err := p.entryExists(3); err != nil || exists {
+				t.Errorf("entry of failed import exists: %v", err)
+			}
+		})
+	}
+}
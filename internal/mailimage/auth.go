@@ -0,0 +1,197 @@
+package mailimage
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+	"golang.org/x/xerrors"
+)
+
+// authResult is the outcome of the authentication of an incoming mail.
+type authResult string
+
+const (
+	// authPass means, that the mail was send by the domain in the from header.
+	authPass authResult = "pass"
+
+	// authFail means, that the mail was not send by the domain in the from
+	// header.
+	authFail authResult = "fail"
+
+	// authNone means, that there is no information about the sender.
+	authNone authResult = "none"
+)
+
+// lookupTXT is used for all dns lookups of dkim keys and dmarc records.
+var lookupTXT = net.LookupTXT
+
+// authConfig contains the settings how incoming mails are authenticated.
+type authConfig struct {
+	// TrustedAuthservIDs are the authserv-ids of the mail servers whose
+	// Authentication-Results headers are trusted. The mail server has to remove
+	// all Authentication-Results headers with this ids from incoming mails.
+	TrustedAuthservIDs []string `toml:"trusted_authserv_ids"`
+
+	// VerifyDKIM enables the local verification of dkim signatures.
+	VerifyDKIM bool `toml:"verify_dkim"`
+
+	// LookupDMARC enables the lookup of the dmarc record of the sender domain,
+	// if the mail could not be authenticated. If the domain has a dmarc policy
+	// other then "none", the mail fails.
+	LookupDMARC bool `toml:"lookup_dmarc"`
+
+	// Fail and None define what happens with mails that fail the
+	// authentication or where the sender is unknown. Possible values are
+	// "accept", "quarantine" and "reject".
+	Fail string `toml:"fail"`
+	None string `toml:"none"`
+}
+
+// action returns the configured action for an authentication result.
+func (c authConfig) action(result authResult) string {
+	switch result {
+	case authFail:
+		return c.Fail
+	case authNone:
+		return c.None
+	}
+	return "accept"
+}
+
+// enabled returns true, if the result of an authentication could change
+// anything.
+func (c authConfig) enabled() bool {
+	return c.Fail != "accept" || c.None != "accept"
+}
+
+// authenticate checks, if the mail was send by the domain of the from address.
+//
+// raw has to be the unmodified mail. header are the top level headers of the
+// same mail.
+func authenticate(raw io.Reader, header textproto.MIMEHeader, fromAddress string) (authResult, error) {
+	fromDomain := strings.ToLower(fromAddress[strings.LastIndex(fromAddress, "@")+1:])
+
+	result := trustedAuthResults(header, fromDomain)
+
+	if result == authNone && cfg.Auth.VerifyDKIM {
+		r, err := verifyDKIM(raw, fromDomain)
+		if err != nil {
+			return authNone, err
+		}
+		result = r
+	}
+
+	if result == authNone && cfg.Auth.LookupDMARC {
+		record, err := dmarc.LookupWithOptions(fromDomain, &dmarc.LookupOptions{LookupTXT: lookupTXT})
+		if err != nil && err != dmarc.ErrNoPolicy {
+			if dmarc.IsTempFail(err) {
+				return authNone, xerrors.Errorf("can not lookup dmarc record for %s: %w", fromDomain, err)
+			}
+			log.Printf("Invalid dmarc record for %s: %v", fromDomain, err)
+		}
+
+		if record != nil && record.Policy != dmarc.PolicyNone {
+			result = authFail
+		}
+	}
+
+	return result, nil
+}
+
+// trustedAuthResults evaluates the Authentication-Results headers that where
+// added by a trusted mail server.
+func trustedAuthResults(header textproto.MIMEHeader, fromDomain string) authResult {
+	result := authNone
+	for _, field := range header["Authentication-Results"] {
+		id, results, err := authres.Parse(field)
+		if err != nil || !isTrustedAuthservID(id) {
+			continue
+		}
+
+		for _, r := range results {
+			switch r := r.(type) {
+			case *authres.DMARCResult:
+				switch r.Value {
+				case authres.ResultPass:
+					return authPass
+				case authres.ResultFail:
+					result = authFail
+				}
+
+			case *authres.DKIMResult:
+				if r.Value == authres.ResultPass && aligned(r.Domain, fromDomain) {
+					return authPass
+				}
+
+			case *authres.SPFResult:
+				mailFrom := r.From[strings.LastIndex(r.From, "@")+1:]
+				if r.Value == authres.ResultPass && aligned(mailFrom, fromDomain) {
+					return authPass
+				}
+			}
+		}
+	}
+	return result
+}
+
+// verifyDKIM verifies the dkim signatures of a mail.
+//
+// Returns authPass, if there is a valid signature of the from domain and
+// authFail if all signatures of the from domain are invalid.
+func verifyDKIM(raw io.Reader, fromDomain string) (authResult, error) {
+	verifications, err := dkim.VerifyWithOptions(raw, &dkim.VerifyOptions{LookupTXT: lookupTXT})
+	if err != nil {
+		return authNone, xerrors.Errorf("can not verify dkim signatures: %w", err)
+	}
+
+	result := authNone
+	for _, v := range verifications {
+		if !aligned(v.Domain, fromDomain) {
+			continue
+		}
+
+		if v.Err == nil {
+			return authPass, nil
+		}
+
+		if dkim.IsTempFail(v.Err) {
+			return authNone, xerrors.Errorf("can not verify dkim signature of %s: %w", v.Domain, v.Err)
+		}
+		result = authFail
+	}
+	return result, nil
+}
+
+// aligned returns true, if both domains have the same organizational domain.
+func aligned(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	if a == b {
+		return true
+	}
+
+	orgA, err := publicsuffix.EffectiveTLDPlusOne(a)
+	if err != nil {
+		return false
+	}
+	orgB, err := publicsuffix.EffectiveTLDPlusOne(b)
+	if err != nil {
+		return false
+	}
+	return orgA == orgB
+}
+
+func isTrustedAuthservID(id string) bool {
+	for _, trusted := range cfg.Auth.TrustedAuthservIDs {
+		if strings.EqualFold(trusted, id) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package mailimage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testDKIMKey returns a key that is generated once for all tests.
+func testDKIMKey(t testing.TB) *rsa.PrivateKey {
+	t.Helper()
+
+	testKeyOnce.Do(func() {
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("can not generate key: %v", err)
+		}
+		testKey = k
+	})
+	return testKey
+}
+
+// stubDNS replaces lookupTXT until the end of the test. records maps names
+// to the txt records. Names that are not in records return err or, if err is
+// nil, a not found error.
+func stubDNS(t testing.TB, records map[string]string, err error) {
+	t.Helper()
+
+	old := lookupTXT
+	lookupTXT = func(name string) ([]string, error) {
+		if record, ok := records[name]; ok {
+			return []string{record}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	t.Cleanup(func() { lookupTXT = old })
+}
+
+// dkimRecord returns the dns name and the txt record of the test key.
+func dkimRecord(t testing.TB, domain string) (string, string) {
+	t.Helper()
+
+	pub, err := x509.MarshalPKIXPublicKey(&testDKIMKey(t).PublicKey)
+	if err != nil {
+		t.Fatalf("can not encode public key: %v", err)
+	}
+	return "test._domainkey." + domain, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// testImage returns a small png image.
+func testImage(t testing.TB) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 30; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 6), uint8(y * 8), 100, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("can not encode image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// testMail returns a mail with an image from the address from. If domain is
+// not empty, the mail is signed with the test key for this domain.
+func testMail(t testing.TB, from, domain string) []byte {
+	t.Helper()
+
+	encoded := base64.StdEncoding.EncodeToString(testImage(t))
+	var body strings.Builder
+	for len(encoded) > 76 {
+		body.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	body.WriteString(encoded + "\r\n")
+
+	mail := strings.Join([]string{
+		"From: Some User <" + from + ">",
+		"To: mailimage@example.com",
+		"Subject: Kohl",
+		"Date: Sun, 19 May 2019 22:17:01 +0200",
+		"Message-ID: <test@example.org>",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/mixed; boundary="b"`,
+		"",
+		"--b",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"Frischer Kohl",
+		"--b",
+		`Content-Type: image/png; name="kohl.png"`,
+		"Content-Transfer-Encoding: base64",
+		"",
+		body.String() + "--b--",
+		"",
+	}, "\r\n")
+
+	if domain == "" {
+		return []byte(mail)
+	}
+
+	var signed bytes.Buffer
+	opts := &dkim.SignOptions{Domain: domain, Selector: "test", Signer: testDKIMKey(t)}
+	if err := dkim.Sign(&signed, strings.NewReader(mail), opts); err != nil {
+		t.Fatalf("can not sign mail: %v", err)
+	}
+	return signed.Bytes()
+}
+
+// mailHeader returns the top level header of a mail.
+func mailHeader(t testing.TB, raw []byte) textproto.MIMEHeader {
+	t.Helper()
+
+	header, _ := readHeader(bytes.NewReader(raw))
+	return header
+}
+
+func TestAuthenticate(t *testing.T) {
+	name, record := dkimRecord(t, "example.org")
+	signed := testMail(t, "user@example.org", "example.org")
+	tampered := bytes.Replace(signed, []byte("Frischer Kohl"), []byte("Fauler Kohl"), 1)
+
+	for _, tt := range []struct {
+		name   string
+		from   string
+		raw    []byte
+		dmarc  bool
+		dnsErr error
+		expect authResult
+		tmpErr bool
+	}{
+		{name: "pass", from: "user@example.org", raw: signed, expect: authPass},
+		{name: "fail", from: "user@example.org", raw: tampered, expect: authFail},
+		{name: "none", from: "user@example.org", raw: testMail(t, "user@example.org", ""), expect: authNone},
+		{name: "other domain", from: "user@example.com", raw: testMail(t, "user@example.com", "example.org"), expect: authNone},
+		{name: "dmarc reject", from: "user@example.org", raw: testMail(t, "user@example.org", ""), dmarc: true, expect: authFail},
+		{name: "temperror", from: "user@example.org", raw: signed, dnsErr: &net.DNSError{Err: "timeout", Name: name, IsTimeout: true, IsTemporary: true}, tmpErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg = defaultConfig()
+			cfg.Auth.VerifyDKIM = true
+			cfg.Auth.LookupDMARC = tt.dmarc
+			t.Cleanup(func() { cfg = defaultConfig() })
+
+			records := map[string]string{
+				"_dmarc.example.org": "v=DMARC1; p=reject",
+			}
+			if tt.dnsErr == nil {
+				records[name] = record
+			}
+			stubDNS(t, records, tt.dnsErr)
+
+			got, err := authenticate(bytes.NewReader(tt.raw), mailHeader(t, tt.raw), tt.from)
+			if tt.tmpErr {
+				if err == nil {
+					t.Fatalf("authenticate returned %s, expected an error", got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("authenticate returned error: %v", err)
+			}
+			if got != tt.expect {
+				t.Errorf("authenticate returned %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
+
+func TestTrustedAuthResults(t *testing.T) {
+	cfg = defaultConfig()
+	cfg.Auth.TrustedAuthservIDs = []string{"mx.example.com"}
+	t.Cleanup(func() { cfg = defaultConfig() })
+
+	for _, tt := range []struct {
+		name   string
+		header string
+		expect authResult
+	}{
+		{"dmarc pass", "mx.example.com; dmarc=pass header.from=example.org", authPass},
+		{"dmarc fail", "mx.example.com; dmarc=fail header.from=example.org", authFail},
+		{"aligned dkim", "mx.example.com; dkim=pass header.d=mail.example.org", authPass},
+		{"untrusted", "evil.example.com; dmarc=pass header.from=example.org", authNone},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			header := textproto.MIMEHeader{"Authentication-Results": {tt.header}}
+			if got := trustedAuthResults(header, "example.org"); got != tt.expect {
+				t.Errorf("trustedAuthResults returned %s, expected %s", got, tt.expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package mailimage
+
+import (
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// recipient contains everything that is needed to respond to an incoming mail.
+type recipient struct {
+	name    string
+	address string
+
+	// messageID and references are used to set the In-Reply-To and References
+	// headers of the response.
+	messageID  string
+	references string
+
+	// automated is true, if the incoming mail was send automatically. No
+	// response is send to such mails.
+	automated bool
+
+	// noReply is true, if the responses are suppressed, for example when a
+	// mail is reprocessed.
+	noReply bool
+
+	// lang is the language of the response.
+	lang string
+}
+
+// newRecipient creates a recipient from the sender of a mail.
+func newRecipient(header textproto.MIMEHeader, from *mail.Address) recipient {
+	return recipient{
+		name:       from.Name,
+		address:    from.Address,
+		messageID:  strings.TrimSpace(header.Get("Message-ID")),
+		references: strings.TrimSpace(header.Get("References")),
+		automated:  isAutomated(header, from),
+		lang:       matchLanguage(header.Get("Accept-Language"), header.Get("Content-Language")),
+	}
+}
+
+// isAutomated returns true, if a mail was send automatically, for example by a
+// vacation auto responder, a mailing list or as a bounce. Responding to such
+// mails could create mail loops.
+func isAutomated(header textproto.MIMEHeader, from *mail.Address) bool {
+	if v := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); v != "" && v != "no" {
+		return true
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return true
+	}
+
+	if header.Get("List-Id") != "" {
+		return true
+	}
+
+	if strings.TrimSpace(header.Get("Return-Path")) == "<>" {
+		return true
+	}
+
+	localPart := from.Address
+	if i := strings.LastIndex(localPart, "@"); i >= 0 {
+		localPart = localPart[:i]
+	}
+	return strings.EqualFold(localPart, "mailer-daemon")
+}
+
+// allowReply returns true, if another error response can be send to the
+// address. It counts the responses for each address for one hour.
+func (p *pool) allowReply(address string) (bool, error) {
+	if cfg.Replies.RateLimit == 0 {
+		return true, nil
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	// The counter is created with its expire time in the same transaction,
+	// so it can not exist without one.
+	k := p.key("replies", strings.ToLower(address))
+	conn.Send("MULTI")
+	conn.Send("SET", k, 0, "EX", 60*60, "NX")
+	conn.Send("INCR", k)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return false, xerrors.Errorf("can not count replies: %w", err)
+	}
+
+	count, err := redis.Int(values[1], nil)
+	if err != nil {
+		return false, xerrors.Errorf("can not count replies: %w", err)
+	}
+	return count <= cfg.Replies.RateLimit, nil
+}
@@ -0,0 +1,53 @@
+package mailimage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestAllowReply(t *testing.T) {
+	p := setupTest(t, "[replies]\nrate_limit = 2\n")
+
+	for i, expect := range []bool{true, true, false} {
+		allowed, err := p.allowReply("User@Example.org")
+		if err != nil {
+			t.Fatalf("allowReply returned error: %v", err)
+		}
+		if allowed != expect {
+			t.Errorf("reply %d: allowReply returned %t, expected %t", i+1, allowed, expect)
+		}
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	ttl, err := redis.Int(conn.Do("TTL", p.key("replies", "user@example.org")))
+	if err != nil {
+		t.Fatalf("can not receive ttl: %v", err)
+	}
+	if ttl <= 0 || ttl > 60*60 {
+		t.Errorf("reply counter has ttl %d, expected at most one hour", ttl)
+	}
+}
+
+func TestSuccessMailIgnoresRateLimit(t *testing.T) {
+	p := setupTest(t, "[replies]\nrate_limit = 1\n")
+
+	if _, err := p.allowReply("user@example.org"); err != nil {
+		t.Fatalf("allowReply returned error: %v", err)
+	}
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board})
+	if err != nil {
+		t.Fatalf("insert returned error: %v", err)
+	}
+	if result.folder != "success" {
+		t.Fatalf("mail is in folder %q, expected success", result.folder)
+	}
+
+	if got := queuedMails(t, p); got != 1 {
+		t.Errorf("%d mails queued, expected the success mail", got)
+	}
+}
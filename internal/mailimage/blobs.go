@@ -0,0 +1,388 @@
+package mailimage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// Images are saved as blobs in the store. Each image is saved once with the
+// sha256 hash of its content as name in the folder blobs/<ab>/<cd>/, where ab
+// and cd are the first four characters of the hash. The thumbnails are saved
+// in the same way in the folder thumbnails. Entries reference their image by the hash
+// in the field blob. The number of references of each blob is counted in the
+// redis hash key("blobs").
+
+// blobHash returns the name of the blob with the given content.
+func blobHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validBlobHash returns true, if hash can be the name of a blob.
+func validBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// blobName returns the name of a blob in the store.
+func blobName(hash string) string {
+	return path.Join("blobs", hash[:2], hash[2:4], hash)
+}
+
+// thumbnailName returns the name of the thumbnail of a blob in the store.
+func thumbnailName(hash string) string {
+	return path.Join("thumbnails", hash[:2], hash[2:4], hash+".jpg")
+}
+
+// blobLockTimeout is the time, a blob is locked while it is removed from the
+// store. linkBlob waits at most this time for the removal.
+const blobLockTimeout = time.Minute
+
+// blobLockRetry is the time between two attempts to link a locked blob.
+const blobLockRetry = 100 * time.Millisecond
+
+// storeBlob saves data into the blob store and returns its hash. If the blob
+// already exists, it is not written again.
+//
+// The blob has to be linked before it is stored. Otherwise it could be
+// removed by unlinkBlob between the check and linking it.
+func (b *board) storeBlob(data []byte) (string, error) {
+	hash := blobHash(data)
+	if _, err := b.store.stat(blobName(hash)); err == nil {
+		return hash, nil
+	}
+
+	if err := b.store.write(blobName(hash), data); err != nil {
+		return "", xerrors.Errorf("can not save blob %s: %w", hash, err)
+	}
+	return hash, nil
+}
+
+// linkScript sets the blob of an entry and counts the reference. Returns 0,
+// if the blob is locked, because it is removed from the store.
+//
+// KEYS: entry key, blobs key, lock key, generation key
+// ARGV: hash
+var linkScript = redis.NewScript(4, `
+if redis.call("EXISTS", KEYS[3]) == 1 then
+	return 0
+end
+redis.call("HSET", KEYS[1], "blob", ARGV[1])
+redis.call("HINCRBY", KEYS[2], ARGV[1], 1)
+redis.call("INCR", KEYS[4])
+return 1
+`)
+
+// blobLockKey returns the key that locks a blob while it is removed.
+func (p *pool) blobLockKey(hash string) string {
+	return p.key("blobremove", hash)
+}
+
+// linkBlob sets the blob of an entry and counts the reference. The entry must
+// not have a blob. If the blob is removed at the moment, it waits until the
+// removal is finished, so the blob can be stored again afterwards.
+func (p *pool) linkBlob(id int, hash string) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	deadline := time.Now().Add(blobLockTimeout)
+	for {
+		linked, err := redis.Bool(linkScript.Do(conn, p.key("entry", strconv.Itoa(id)), p.key("blobs"), p.blobLockKey(hash), p.generationKey(), hash))
+		if err != nil {
+			return xerrors.Errorf("can not link blob to entry %d: %w", id, err)
+		}
+		if linked {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return xerrors.Errorf("can not link blob to entry %d: blob %s is locked", id, hash)
+		}
+		time.Sleep(blobLockRetry)
+	}
+}
+
+// unlinkScript removes the blob from an entry and decrements its reference
+// counter. Returns 1, if the blob is not referenced anymore. In this case the
+// blob is locked until the lock key is deleted or expires. Returns nil, if
+// the entry does not have the blob.
+//
+// KEYS: entry key, blobs key, lock key
+// ARGV: hash, lock timeout in milliseconds
+var unlinkScript = redis.NewScript(3, `
+if redis.call("HGET", KEYS[1], "blob") ~= ARGV[1] then
+	return nil
+end
+redis.call("HDEL", KEYS[1], "blob")
+local refs = redis.call("HINCRBY", KEYS[2], ARGV[1], -1)
+if refs > 0 then
+	return 0
+end
+redis.call("HDEL", KEYS[2], ARGV[1])
+redis.call("SET", KEYS[3], 1, "PX", ARGV[2])
+return 1
+`)
+
+// unlinkBlob removes the blob from an entry. If the blob is not used by
+// another entry, it is deleted with its thumbnail. It does not fail, if the
+// entry has no blob.
+//
+// The blob is locked while it is deleted, so linkBlob can not reference it
+// until it is gone and has to be stored again.
+func (p *pool) unlinkBlob(id int) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	hash, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "blob"))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("can not receive blob of entry %d: %w", id, err)
+	}
+
+	unused, err := redis.Bool(unlinkScript.Do(conn, p.key("entry", strconv.Itoa(id)), p.key("blobs"), p.blobLockKey(hash), hash, blobLockTimeout.Milliseconds()))
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return xerrors.Errorf("can not unlink blob of entry %d: %w", id, err)
+	}
+
+	if !unused {
+		return nil
+	}
+
+	err = p.removeBlob(hash)
+	if _, unlockErr := conn.Do("DEL", p.blobLockKey(hash)); unlockErr != nil && err == nil {
+		err = xerrors.Errorf("can not unlock blob %s: %w", hash, unlockErr)
+	}
+	return err
+}
+
+// undoLinkBlob unlinks the blob of an entry after saving the entry failed.
+// Errors are only logged, because the original error is returned.
+func (p *pool) undoLinkBlob(id int) {
+	if err := p.unlinkBlob(id); err != nil {
+		log.Printf("Can not unlink blob of entry %d: %v", id, err)
+	}
+}
+
+// removeBlob deletes a blob and its thumbnail from the store.
+func (b *board) removeBlob(hash string) error {
+	for _, name := range []string{blobName(hash), thumbnailName(hash)} {
+		if err := b.store.remove(name); err != nil {
+			return xerrors.Errorf("can not delete %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// blobRefs returns the reference counter of all blobs.
+func (p *pool) blobRefs() (map[string]int, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	refs, err := redis.IntMap(conn.Do("HGETALL", p.key("blobs")))
+	if err != nil {
+		return nil, xerrors.Errorf("can not receive blob references: %w", err)
+	}
+	return refs, nil
+}
+
+// entryBlobs returns the blobs of all entries including the entries in the
+// trash. Entries that are not migrated have an empty blob.
+func (p *pool) entryBlobs() (map[int]string, error) {
+	ids, err := p.entryKeys("")
+	if err != nil {
+		return nil, err
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	blobs := make(map[int]string)
+	for _, id := range sortedIDs(ids) {
+		values, err := redis.Strings(conn.Do("HMGET", p.key("entry", strconv.Itoa(id)), "fileext", "blob"))
+		if err != nil {
+			return nil, xerrors.Errorf("can not receive entry %d: %w", id, err)
+		}
+
+		// Ignore broken entries without image. They are found by fsck.
+		if values[0] == "" {
+			continue
+		}
+		blobs[id] = values[1]
+	}
+	return blobs, nil
+}
+
+// legacyImageNames returns the names where the image and the thumbnail of an
+// entry where saved before the blob store. The entry can be in the trash.
+func legacyImageNames(id int, ext string) []string {
+	var names []string
+	for _, folder := range []string{"", "trash"} {
+		names = append(names,
+			path.Join(folder, "images", fmt.Sprintf("%d%s", id, ext)),
+			path.Join(folder, "thumbnail", fmt.Sprintf("%d.jpg", id)),
+		)
+	}
+	return names
+}
+
+// migrateBlob moves the image of an entry from the old layout into the blob
+// store. The old image and thumbnail are deleted. It does nothing, if the
+// entry is already migrated.
+func (p *pool) migrateBlob(id int) error {
+	conn := p.Get()
+	values, err := redis.Strings(conn.Do("HMGET", p.key("entry", strconv.Itoa(id)), "fileext", "blob"))
+	conn.Close()
+	if err != nil {
+		return xerrors.Errorf("can not receive entry %d: %w", id, err)
+	}
+
+	ext, blob := values[0], values[1]
+	if ext == "" {
+		return errUnknownImage
+	}
+
+	legacy := legacyImageNames(id, ext)
+	if blob == "" {
+		var data []byte
+		for _, image := range []string{legacy[0], legacy[2]} {
+			data, err = p.readBlob(image)
+			if err == nil || !os.IsNotExist(err) {
+				break
+			}
+		}
+		if err != nil {
+			return xerrors.Errorf("can not read image of entry %d: %w", id, err)
+		}
+
+		if err := p.linkBlob(id, blobHash(data)); err != nil {
+			return err
+		}
+
+		if _, err := p.storeBlob(data); err != nil {
+			p.undoLinkBlob(id)
+			return err
+		}
+	}
+
+	for _, name := range legacy {
+		if err := p.store.remove(name); err != nil {
+			return xerrors.Errorf("can not delete %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// unmigratedEntries returns the ids of the entries whose image is not in the
+// blob store.
+func (p *pool) unmigratedEntries() ([]int, error) {
+	blobs, err := p.entryBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for id, blob := range blobs {
+		if blob == "" {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// MigrateBlobs moves all images from the folders images and thumbnail into the
+// blob store.
+func MigrateBlobs(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	return migrateBlobs(pool, w)
+}
+
+// migrateBlobs moves the images of all entries that are not migrated into the
+// blob store. It is also the migration to schema version 2.
+func migrateBlobs(p *pool, w io.Writer) error {
+	ids, err := p.unmigratedEntries()
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, id := range ids {
+		if err := p.migrateBlob(id); err != nil {
+			fmt.Fprintf(w, "entry %d: %v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "entry %d: migrated\n", id)
+	}
+
+	// Remove the old folders, if they are empty
+	for _, folder := range []string{"images", "thumbnail", "trash/images", "trash/thumbnail"} {
+		os.Remove(path.Join(p.path, folder))
+	}
+
+	fmt.Fprintf(w, "%d entries migrated, %d failed\n", len(ids)-failed, failed)
+	if failed > 0 {
+		return xerrors.Errorf("%d entries could not be migrated", failed)
+	}
+	return nil
+}
+
+// Blobs writes statistics about the blob store to w.
+func Blobs(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	refs, err := pool.blobRefs()
+	if err != nil {
+		return err
+	}
+
+	unmigrated, err := pool.unmigratedEntries()
+	if err != nil {
+		return err
+	}
+
+	var references int
+	var size, saved int64
+	for hash, count := range refs {
+		references += count
+		info, err := pool.store.stat(blobName(hash))
+		if err != nil {
+			continue
+		}
+		size += info.size
+		saved += int64(count-1) * info.size
+	}
+
+	fmt.Fprintf(w, "Blobs:       %d\n", len(refs))
+	fmt.Fprintf(w, "References:  %d\n", references)
+	fmt.Fprintf(w, "Size:        %d bytes\n", size)
+	fmt.Fprintf(w, "Saved:       %d bytes\n", saved)
+	fmt.Fprintf(w, "Unmigrated:  %d entries\n", len(unmigrated))
+	return nil
+}
@@ -0,0 +1,94 @@
+package mailimage
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestLinkBlobWaitsForRemoval(t *testing.T) {
+	p := setupTest(t, "")
+	data := testImage(t)
+	hash := blobHash(data)
+
+	conn := p.Get()
+	defer conn.Close()
+
+	// Lock the blob like unlinkBlob does while it is removed.
+	if _, err := conn.Do("SET", p.blobLockKey(hash), 1); err != nil {
+		t.Fatalf("can not lock blob: %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- p.linkBlob(1, hash) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("linkBlob returned while the blob is locked: %v", err)
+	case <-time.After(3 * blobLockRetry):
+	}
+
+	refs, err := p.blobRefs()
+	if err != nil {
+		t.Fatalf("blobRefs returned error: %v", err)
+	}
+	if refs[hash] != 0 {
+		t.Errorf("locked blob has %d references", refs[hash])
+	}
+
+	if _, err := conn.Do("DEL", p.blobLockKey(hash)); err != nil {
+		t.Fatalf("can not unlock blob: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("linkBlob returned error: %v", err)
+	}
+
+	refs, err = p.blobRefs()
+	if err != nil {
+		t.Fatalf("blobRefs returned error: %v", err)
+	}
+	if refs[hash] != 1 {
+		t.Errorf("blob has %d references, expected 1", refs[hash])
+	}
+}
+
+func TestUnlinkBlobRemovesUnusedBlob(t *testing.T) {
+	p := setupTest(t, "")
+	data := testImage(t)
+	hash := blobHash(data)
+
+	for _, id := range []int{1, 2} {
+		if err := p.linkBlob(id, hash); err != nil {
+			t.Fatalf("linkBlob returned error: %v", err)
+		}
+	}
+	if _, err := p.storeBlob(data); err != nil {
+		t.Fatalf("storeBlob returned error: %v", err)
+	}
+
+	if err := p.unlinkBlob(1); err != nil {
+		t.Fatalf("unlinkBlob returned error: %v", err)
+	}
+	if _, err := p.store.stat(blobName(hash)); err != nil {
+		t.Errorf("blob that is still used was removed: %v", err)
+	}
+
+	if err := p.unlinkBlob(2); err != nil {
+		t.Fatalf("unlinkBlob returned error: %v", err)
+	}
+	if _, err := p.store.stat(blobName(hash)); !os.IsNotExist(err) {
+		t.Errorf("unused blob was not removed: %v", err)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+	locked, err := redis.Bool(conn.Do("EXISTS", p.blobLockKey(hash)))
+	if err != nil {
+		t.Fatalf("can not check lock: %v", err)
+	}
+	if locked {
+		t.Errorf("blob is still locked after the removal")
+	}
+}
@@ -0,0 +1,427 @@
+package mailimage
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/xerrors"
+)
+
+// boardConfig contains the settings of one board. One process can serve more
+// than one board. Each board has its own entries in redis, its own files and
+// its own website.
+type boardConfig struct {
+	// Name identifies the board, for example with the flag --board.
+	Name string `toml:"name"`
+
+	// Title is the name of the board in the mails. From is the sender of
+	// the mails. It defaults to the title with the first address.
+	Title string `toml:"title"`
+	From  string `toml:"from"`
+
+	// Addresses are the recipients of the board, for example
+	// "harvest@example.com" or "mailimage+harvest@example.com". Mails are
+	// sorted to the boards by the headers Delivered-To, To and Cc. A board
+	// without addresses gets all mails that do not match another board.
+	Addresses []string `toml:"addresses"`
+
+	// Hosts and PathPrefix select the board on the website. A board without
+	// both gets all requests that do not match another board.
+	Hosts      []string `toml:"hosts"`
+	PathPrefix string   `toml:"path_prefix"`
+
+	// BaseURL is the url of the website of the board in the mails. It
+	// defaults to https://<first host><path prefix>. DeleteRedirectURL is
+	// the page that is linked after an image was deleted. It defaults to
+	// BaseURL.
+	BaseURL           string `toml:"base_url"`
+	DeleteRedirectURL string `toml:"delete_redirect_url"`
+
+	// Folder is the folder of the board below MAILIMAGE_PATH and below
+	// storage.prefix in the s3 store. It defaults to the name. "." uses the
+	// folder itself.
+	Folder string `toml:"folder"`
+
+	// RedisPrefix is put before all redis keys of the board. It defaults to
+	// <redis.prefix>:<name>.
+	RedisPrefix string `toml:"redis_prefix"`
+
+	// TemplateDir and Limits replace the global settings for the board.
+	TemplateDir string       `toml:"template_dir"`
+	Limits      *limitConfig `toml:"limits"`
+}
+
+// board contains everything that is separate for each board. The pool of a
+// board embeds it.
+type board struct {
+	name              string
+	title             string
+	from              string
+	addresses         []string
+	hosts             []string
+	pathPrefix        string
+	baseURL           string
+	deleteRedirectURL string
+	redisPrefix       string
+	templateDir       string
+	limits            limitConfig
+
+	// path is the folder of the board on the local disk. It contains the
+	// progress folder and all files of the file store.
+	path  string
+	store blobStore
+
+	templatesMu sync.RWMutex
+	templates   *templateSet
+}
+
+var boardNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// newBoard creates a board from its config. Values that are not set are taken
+// from the global config.
+func newBoard(c config, bc boardConfig) (*board, error) {
+	if !boardNamePattern.MatchString(bc.Name) {
+		return nil, xerrors.Errorf("invalid board name %q: use lower case letters, digits, - and _", bc.Name)
+	}
+
+	b := &board{
+		name:              bc.Name,
+		title:             bc.Title,
+		from:              bc.From,
+		addresses:         bc.Addresses,
+		pathPrefix:        strings.TrimSuffix(bc.PathPrefix, "/"),
+		baseURL:           strings.TrimSuffix(bc.BaseURL, "/"),
+		deleteRedirectURL: bc.DeleteRedirectURL,
+		redisPrefix:       bc.RedisPrefix,
+		templateDir:       bc.TemplateDir,
+		limits:            c.Limits,
+	}
+
+	for _, host := range bc.Hosts {
+		b.hosts = append(b.hosts, strings.ToLower(host))
+	}
+
+	if b.pathPrefix != "" && !strings.HasPrefix(b.pathPrefix, "/") {
+		return nil, xerrors.Errorf("board %s: path_prefix has to start with /", b.name)
+	}
+
+	for _, address := range b.addresses {
+		if _, err := mail.ParseAddress(address); err != nil {
+			return nil, xerrors.Errorf("board %s: invalid address %q: %w", b.name, address, err)
+		}
+	}
+
+	if b.title == "" {
+		b.title = b.name
+	}
+
+	if b.from == "" {
+		b.from = fromAdress
+		if len(b.addresses) > 0 {
+			b.from = (&mail.Address{Name: b.title, Address: b.addresses[0]}).String()
+		}
+	}
+
+	if b.baseURL == "" {
+		b.baseURL = baseURL + b.pathPrefix
+		if len(b.hosts) > 0 {
+			b.baseURL = "https://" + b.hosts[0] + b.pathPrefix
+		}
+	}
+
+	if b.deleteRedirectURL == "" {
+		b.deleteRedirectURL = b.baseURL
+	}
+
+	if b.redisPrefix == "" {
+		b.redisPrefix = c.Redis.Prefix + ":" + b.name
+	}
+
+	if b.templateDir == "" {
+		b.templateDir = c.TemplateDir
+	}
+
+	if bc.Limits != nil {
+		b.limits = *bc.Limits
+	}
+
+	folder := bc.Folder
+	if folder == "" {
+		folder = b.name
+	}
+	if path.Clean(folder) == unroutedFolder {
+		return nil, xerrors.Errorf("board %s: the folder %s is used for mails without board", b.name, unroutedFolder)
+	}
+	if err := b.setFolder(c, folder); err != nil {
+		return nil, xerrors.Errorf("board %s: %w", b.name, err)
+	}
+	return b, nil
+}
+
+// newDefaultBoard creates the board that is used, if no boards are configured.
+// It uses the global config and the folder and redis keys of the time before
+// boards.
+func newDefaultBoard(c config) (*board, error) {
+	b := &board{
+		title:             boardName,
+		from:              fromAdress,
+		baseURL:           baseURL,
+		deleteRedirectURL: deleteRedirectURL,
+		redisPrefix:       c.Redis.Prefix,
+		templateDir:       c.TemplateDir,
+		limits:            c.Limits,
+	}
+
+	if err := b.setFolder(c, "."); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// setFolder sets the folder of the board on the disk and creates its store.
+func (b *board) setFolder(c config, folder string) error {
+	folder = path.Clean(folder)
+	if path.IsAbs(folder) || folder == ".." || strings.HasPrefix(folder, "../") {
+		return xerrors.Errorf("folder %s has to be below MAILIMAGE_PATH", folder)
+	}
+
+	s, err := newBlobStore(c.Storage, folder)
+	if err != nil {
+		return err
+	}
+
+	b.path = filepath.Join(mailimagePath(), filepath.FromSlash(folder))
+	b.store = s
+	return nil
+}
+
+// String returns the name of the board for messages.
+func (b *board) String() string {
+	if b.name == "" {
+		return "default"
+	}
+	return b.name
+}
+
+// key creates a redis key with the prefix of the board from a list of
+// strings.
+func (b *board) key(keys ...string) string {
+	return fmt.Sprintf("%s:%s", b.redisPrefix, strings.Join(keys, ":"))
+}
+
+// postURL returns the link to the page of an entry.
+func (b *board) postURL(id int) string {
+	return fmt.Sprintf("%s/post/%d", b.baseURL, id)
+}
+
+// boards are the boards from the config. It is replaced by LoadConfig.
+var boards []*board
+
+// selected is the board that was selected with SelectBoard.
+var selected *board
+
+// newBoards creates the boards from the config and checks, that they do not
+// share their data.
+func newBoards(c config) ([]*board, error) {
+	if len(c.Boards) == 0 {
+		b, err := newDefaultBoard(c)
+		if err != nil {
+			return nil, err
+		}
+		return []*board{b}, nil
+	}
+
+	var result []*board
+	names := make(map[string]bool)
+	addresses := make(map[string]string)
+	var mailDefault, webDefault string
+	for _, bc := range c.Boards {
+		b, err := newBoard(c, bc)
+		if err != nil {
+			return nil, err
+		}
+
+		if names[b.name] {
+			return nil, xerrors.Errorf("board %s is defined twice", b.name)
+		}
+		names[b.name] = true
+
+		// The keys and files of one board must not contain the ones of
+		// another board, for example the prefixes "mailimage" and
+		// "mailimage:entry" or the folders "." and "harvest".
+		for _, other := range result {
+			if nestedRedisPrefix(b.redisPrefix, other.redisPrefix) {
+				return nil, xerrors.Errorf("boards %s and %s use the same or nested redis prefixes", other.name, b.name)
+			}
+
+			if isBelow(b.path, other.path) || isBelow(other.path, b.path) {
+				return nil, xerrors.Errorf("boards %s and %s use the same or nested folders", other.name, b.name)
+			}
+		}
+
+		for _, address := range b.addresses {
+			address = strings.ToLower(address)
+			if other, ok := addresses[address]; ok {
+				return nil, xerrors.Errorf("boards %s and %s use the address %s", other, b.name, address)
+			}
+			addresses[address] = b.name
+		}
+
+		if len(b.addresses) == 0 {
+			if mailDefault != "" {
+				return nil, xerrors.Errorf("boards %s and %s have no addresses, only one board can get the mails for unknown addresses", mailDefault, b.name)
+			}
+			mailDefault = b.name
+		}
+
+		if len(b.hosts) == 0 && b.pathPrefix == "" {
+			if webDefault != "" {
+				return nil, xerrors.Errorf("boards %s and %s have no hosts and no path_prefix, only one board can get the unknown requests", webDefault, b.name)
+			}
+			webDefault = b.name
+		}
+
+		result = append(result, b)
+	}
+	return result, nil
+}
+
+// nestedRedisPrefix returns true, if the keys with one prefix can be keys
+// with the other prefix.
+func nestedRedisPrefix(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+":") || strings.HasPrefix(b, a+":")
+}
+
+// SelectBoard selects the board for all following functions. An empty name
+// selects no board.
+func SelectBoard(name string) error {
+	selected = nil
+	if name == "" {
+		return nil
+	}
+
+	for _, b := range boards {
+		if b.name == name {
+			selected = b
+			return nil
+		}
+	}
+	return xerrors.Errorf("unknown board: %s", name)
+}
+
+// currentBoard returns the board for functions that work with one board. It
+// is the selected board or the only board from the config.
+func currentBoard() (*board, error) {
+	if selected != nil {
+		return selected, nil
+	}
+
+	if len(boards) == 1 {
+		return boards[0], nil
+	}
+	return nil, xerrors.New("more than one board is configured, select one with --board")
+}
+
+// errNoBoard is returned by routeMail, if no board gets the mail.
+var errNoBoard = xerrors.New("no board for the recipients of the mail")
+
+// routeMail returns the board of a mail. The recipients from the headers
+// Delivered-To, To and Cc are compared with the addresses of the boards in
+// this order. If no address matches, the board without addresses is used.
+func routeMail(header textproto.MIMEHeader) (*board, error) {
+	for _, name := range []string{"Delivered-To", "To", "Cc"} {
+		for _, value := range header[name] {
+			list, err := mail.ParseAddressList(value)
+			if err != nil {
+				continue
+			}
+
+			for _, recipient := range list {
+				for _, b := range boards {
+					for _, address := range b.addresses {
+						if strings.EqualFold(address, recipient.Address) {
+							return b, nil
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, b := range boards {
+		if len(b.addresses) == 0 {
+			return b, nil
+		}
+	}
+	return nil, errNoBoard
+}
+
+// boardRouter sends each request to the handler of its board.
+type boardRouter []boardRoute
+
+// boardRoute is the handler of one board.
+type boardRoute struct {
+	board   *board
+	handler http.Handler
+}
+
+// match returns the route of a request. A board with a matching host wins
+// over a board without hosts. Of those, the board with the longest matching
+// path prefix wins.
+func (rt boardRouter) match(r *http.Request) (boardRoute, bool) {
+	host := strings.ToLower(r.Host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var best boardRoute
+	bestScore := -1
+	for _, route := range rt {
+		b := route.board
+		if b.pathPrefix != "" && r.URL.Path != b.pathPrefix && !strings.HasPrefix(r.URL.Path, b.pathPrefix+"/") {
+			continue
+		}
+
+		score := len(b.pathPrefix)
+		if len(b.hosts) > 0 {
+			found := false
+			for _, h := range b.hosts {
+				found = found || h == host
+			}
+			if !found {
+				continue
+			}
+			score += 1 << 16
+		}
+
+		if score > bestScore {
+			best, bestScore = route, score
+		}
+	}
+	return best, bestScore >= 0
+}
+
+func (rt boardRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := rt.match(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Relative links only work below the folder of the board
+	prefix := route.board.pathPrefix
+	if prefix != "" && r.URL.Path == prefix {
+		http.Redirect(w, r, prefix+"/", http.StatusMovedPermanently)
+		return
+	}
+
+	http.StripPrefix(prefix, route.handler).ServeHTTP(w, r)
+}
@@ -0,0 +1,95 @@
+package mailimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewBoardsSeparateData(t *testing.T) {
+	os.Setenv("MAILIMAGE_PATH", t.TempDir())
+	t.Cleanup(func() { os.Unsetenv("MAILIMAGE_PATH") })
+
+	for _, tt := range []struct {
+		name   string
+		boards []boardConfig
+		valid  bool
+	}{
+		{
+			name:   "defaults",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}}, {Name: "garden"}},
+			valid:  true,
+		},
+		{
+			name:   "same folder",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}}, {Name: "garden", Folder: "harvest"}},
+		},
+		{
+			name:   "nested folder",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}, Folder: "."}, {Name: "garden", Folder: "success"}},
+		},
+		{
+			name:   "similar folder",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}}, {Name: "garden", Folder: "harvest2"}},
+			valid:  true,
+		},
+		{
+			name:   "unrouted folder",
+			boards: []boardConfig{{Name: "unrouted"}},
+		},
+		{
+			name:   "same redis prefix",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}}, {Name: "garden", RedisPrefix: "mailimage:harvest"}},
+		},
+		{
+			name:   "nested redis prefix",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}, RedisPrefix: "mailimage"}, {Name: "garden", RedisPrefix: "mailimage:entry"}},
+		},
+		{
+			name:   "similar redis prefix",
+			boards: []boardConfig{{Name: "harvest", Addresses: []string{"harvest@example.com"}, Hosts: []string{"harvest.example.com"}, RedisPrefix: "mailimage"}, {Name: "garden", RedisPrefix: "mailimage-garden"}},
+			valid:  true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			c.Boards = tt.boards
+
+			_, err := newBoards(c)
+			if tt.valid && err != nil {
+				t.Errorf("newBoards returned error: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("newBoards returned no error")
+			}
+		})
+	}
+}
+
+func TestInsertSavesUnroutedMail(t *testing.T) {
+	setupTest(t, "[[boards]]\nname = \"harvest\"\naddresses = [\"harvest@example.com\"]\n")
+	raw := testMail(t, "user@example.org", "")
+
+	result, err := insert(bytes.NewReader(raw), insertOptions{})
+	if err != errNoBoard {
+		t.Fatalf("insert returned %v, expected %v", err, errNoBoard)
+	}
+	if result.folder != unroutedFolder {
+		t.Errorf("mail is in folder %q, expected %s", result.folder, unroutedFolder)
+	}
+
+	files, err := filepath.Glob(filepath.Join(mailimagePath(), unroutedFolder, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("found unrouted mails %v: %v", files, err)
+	}
+
+	saved, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatalf("can not read unrouted mail: %v", err)
+	}
+	if !bytes.Equal(saved, raw) {
+		t.Errorf("unrouted mail is not the original mail")
+	}
+}
@@ -0,0 +1,80 @@
+package mailimage
+
+import (
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// cacheConfig contains the settings of the entry cache.
+type cacheConfig struct {
+	// Enabled keeps the entries of the index page in the memory of the
+	// webserver. Every change of an entry increments a counter in redis. The
+	// cache is reloaded when the counter changes, so the webserver sees
+	// changes from other processes like `mailimage insert`.
+	Enabled bool `toml:"enabled"`
+}
+
+// entryCache holds all listed entries, the newest first.
+type entryCache struct {
+	mu         sync.Mutex
+	loaded     bool
+	generation int
+	entries    []entry
+}
+
+// page returns count entries after skipping offset entries and the number of
+// all entries like pool.entryPage. The entries are reloaded, if they were
+// changed since the last call.
+func (c *entryCache) page(p *pool, offset, count int) ([]entry, int, error) {
+	entries, err := c.current(p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	end := total
+	if count > 0 && offset+count < total {
+		end = offset + count
+	}
+	return entries[offset:end], total, nil
+}
+
+// current returns all entries. They are loaded from redis, if the generation
+// counter has changed.
+func (c *entryCache) current(p *pool) ([]entry, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	generation, err := redis.Int(conn.Do("GET", p.generationKey()))
+	if err != nil && err != redis.ErrNil {
+		return nil, xerrors.Errorf("can not receive entry generation: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.loaded && c.generation == generation {
+		return c.entries, nil
+	}
+
+	// The generation was read before the entries. If they are changed in the
+	// meantime, they are loaded again with the next call.
+	entries, err := p.listEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	c.entries = entries
+	c.generation = generation
+	c.loaded = true
+	return entries, nil
+}
@@ -0,0 +1,173 @@
+package mailimage
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+// msgKey identifies a text in the message catalog.
+type msgKey string
+
+const (
+	msgNoImage        msgKey = "no_image"
+	msgMultiImage     msgKey = "multi_image"
+	msgParsingImage   msgKey = "parsing_image"
+	msgLongSubject    msgKey = "long_subject"
+	msgLongText       msgKey = "long_text"
+	msgInternal       msgKey = "internal"
+	msgSenderRejected msgKey = "sender_rejected"
+	msgQuota          msgKey = "quota"
+	msgDuplicate      msgKey = "duplicate"
+
+	msgErrorSubject  msgKey = "error_subject"
+	msgExpirySubject msgKey = "expiry_subject"
+	msgRegards       msgKey = "regards"
+	msgDateFormat    msgKey = "date_format"
+	msgNoImages      msgKey = "no_images"
+	msgBack          msgKey = "back"
+	msgNotFound      msgKey = "not_found"
+	msgServerError   msgKey = "server_error"
+	msgDeleted       msgKey = "deleted"
+	msgUndo          msgKey = "undo"
+	msgUndoUntil     msgKey = "undo_until"
+	msgPrevPage      msgKey = "prev_page"
+	msgNextPage      msgKey = "next_page"
+	msgNotAllowed    msgKey = "not_allowed"
+	msgTrash         msgKey = "trash"
+	msgEmptyTrash    msgKey = "empty_trash"
+	msgRestore       msgKey = "restore"
+	msgSubject       msgKey = "subject"
+	msgFrom          msgKey = "from"
+	msgDeletedOn     msgKey = "deleted_on"
+	msgPurgedOn      msgKey = "purged_on"
+)
+
+// catalog contains all texts that are shown to the user for each supported
+// language. The values are format strings for fmt.Sprintf.
+var catalog = map[string]map[msgKey]string{
+	"de": {
+		msgNoImage:        "Keine Bilddatei in der E-Mail gefunden.",
+		msgMultiImage:     "Mehrere Bilder gefunden. Die E-Mail darf maximal ein Bild enthalten.",
+		msgParsingImage:   "Die Bilddatei kann nicht gelesen werden.",
+		msgLongSubject:    "E-Mail Betreff ist zu lang. Maximal %d Zeichen sind erlaubt.",
+		msgLongText:       "Text der E-Mail darf maximal %d Zeichen lang sein.",
+		msgInternal:       "Ups, etwas ist schief gelaufen. Bitte die Admins benachrichtigen.",
+		msgSenderRejected: "Deine E-Mail-Adresse darf keine Bilder veröffentlichen.",
+		msgQuota:          "Du hast zu viele Bilder veröffentlicht. Ab %s Uhr kannst du wieder Bilder senden.",
+		msgDuplicate:      "Das Bild wurde bereits veröffentlicht: %s",
+
+		msgErrorSubject:  "Fehler",
+		msgExpirySubject: "Dein Bild \"%s\" wird bald gelöscht",
+		msgRegards:       "Viele Grüße\n%s",
+		msgDateFormat:    "02.01.2006 15:04",
+		msgNoImages:      "Keine Bilder vorhanden.",
+		msgBack:          "Zurück zur Übersicht",
+		msgNotFound:      "Die Seite existiert nicht.",
+		msgServerError:   "Ups, etwas ist schief gelaufen.",
+		msgDeleted:       "Das Bild wurde gelöscht.",
+		msgUndo:          "Löschen rückgängig machen",
+		msgUndoUntil:     "Bis %s Uhr kannst du das Löschen rückgängig machen.",
+		msgPrevPage:      "Neuere Bilder",
+		msgNextPage:      "Ältere Bilder",
+		msgNotAllowed:    "Die Seite kann so nicht aufgerufen werden.",
+		msgTrash:         "Papierkorb",
+		msgEmptyTrash:    "Der Papierkorb ist leer.",
+		msgRestore:       "Wiederherstellen",
+		msgSubject:       "Betreff",
+		msgFrom:          "Von",
+		msgDeletedOn:     "Gelöscht",
+		msgPurgedOn:      "Endgültig gelöscht",
+	},
+
+	"en": {
+		msgNoImage:        "No image found in the mail.",
+		msgMultiImage:     "More than one image found. The mail can contain only one image.",
+		msgParsingImage:   "The image can not be read.",
+		msgLongSubject:    "The subject of the mail is too long. At most %d characters are allowed.",
+		msgLongText:       "The text of the mail can have at most %d characters.",
+		msgInternal:       "Oops, something went wrong. Please contact the admins.",
+		msgSenderRejected: "Your mail address is not allowed to post images.",
+		msgQuota:          "You posted too many images. You can post images again at %s.",
+		msgDuplicate:      "The image was already posted: %s",
+
+		msgErrorSubject:  "Error",
+		msgExpirySubject: "Your image \"%s\" will be deleted soon",
+		msgRegards:       "Kind regards\n%s",
+		msgDateFormat:    "2006-01-02 15:04",
+		msgNoImages:      "No images yet.",
+		msgBack:          "Back to the overview",
+		msgNotFound:      "The page does not exist.",
+		msgServerError:   "Oops, something went wrong.",
+		msgDeleted:       "The image was deleted.",
+		msgUndo:          "Undo",
+		msgUndoUntil:     "You can undo the deletion until %s.",
+		msgPrevPage:      "Newer images",
+		msgNextPage:      "Older images",
+		msgNotAllowed:    "The page can not be requested this way.",
+		msgTrash:         "Trash",
+		msgEmptyTrash:    "The trash is empty.",
+		msgRestore:       "Restore",
+		msgSubject:       "Subject",
+		msgFrom:          "From",
+		msgDeletedOn:     "Deleted",
+		msgPurgedOn:      "Purged",
+	},
+}
+
+// languages are the supported languages in the same order as languageCodes.
+var (
+	languages     = []language.Tag{language.German, language.English}
+	languageCodes = []string{"de", "en"}
+)
+
+var languageMatcher = language.NewMatcher(languages)
+
+// translate returns the text for a key in the given language. Arguments of
+// type time.Time are formatted with the date format of the language.
+func translate(lang string, key msgKey, args ...interface{}) string {
+	bundle, ok := catalog[lang]
+	if !ok {
+		bundle = catalog[cfg.Language]
+	}
+
+	formatted := make([]interface{}, len(args))
+	for i, arg := range args {
+		formatted[i] = arg
+		if t, ok := arg.(time.Time); ok {
+			formatted[i] = formatDate(lang, t)
+		}
+	}
+
+	return fmt.Sprintf(bundle[key], formatted...)
+}
+
+// formatDate formats a time with the date format of the given language.
+func formatDate(lang string, t time.Time) string {
+	return t.Format(translate(lang, msgDateFormat))
+}
+
+// matchLanguage returns the supported language that fits best to the given
+// language preferences. Each preference has the format of an Accept-Language
+// header. If no language fits, the configured language is returned.
+func matchLanguage(preferences ...string) string {
+	var tags []language.Tag
+	for _, preference := range preferences {
+		t, _, err := language.ParseAcceptLanguage(preference)
+		if err != nil {
+			continue
+		}
+		tags = append(tags, t...)
+	}
+
+	if len(tags) == 0 {
+		return cfg.Language
+	}
+
+	_, index, confidence := languageMatcher.Match(tags...)
+	if confidence == language.No {
+		return cfg.Language
+	}
+	return languageCodes[index]
+}
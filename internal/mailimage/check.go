@@ -0,0 +1,244 @@
+package mailimage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/jhillyerd/enmime"
+	"golang.org/x/xerrors"
+)
+
+// checkReport is the result of Check.
+type checkReport struct {
+	From      string        `json:"from"`
+	Subject   string        `json:"subject"`
+	Board     string        `json:"board"`
+	Text      string        `json:"text"`
+	Lifetime  string        `json:"lifetime,omitempty"`
+	Language  string        `json:"language"`
+	Automated bool          `json:"automated"`
+	Image     *checkImage   `json:"image,omitempty"`
+	Sender    string        `json:"sender"`
+	Auth      *checkAuth    `json:"auth,omitempty"`
+	Duplicate int           `json:"duplicate,omitempty"`
+	Limits    []quotaStatus `json:"limits,omitempty"`
+	Errors    []string      `json:"errors"`
+	Notes     []string      `json:"notes,omitempty"`
+	Valid     bool          `json:"valid"`
+}
+
+// checkImage describes the image of a checked mail.
+type checkImage struct {
+	Extension string `json:"extension"`
+	Size      int    `json:"size"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+}
+
+// checkAuth is the authentication result of a checked mail.
+type checkAuth struct {
+	Result authResult `json:"result"`
+	Action string     `json:"action"`
+}
+
+// Check runs all validations of Insert on a mail and writes a report to w.
+// Nothing is saved and no mail is send. If asJSON is true, the report is
+// written as JSON. Returns true, if the mail would be inserted.
+func Check(w io.Writer, r io.Reader, asJSON bool) (bool, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, xerrors.Errorf("can not read mail: %w", err)
+	}
+
+	report, err := checkMail(raw)
+	if err != nil {
+		return false, err
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return false, xerrors.Errorf("can not encode report: %w", err)
+		}
+		return report.Valid, nil
+	}
+
+	writeCheckReport(w, report)
+	return report.Valid, nil
+}
+
+// checkMail validates a mail without side effects.
+func checkMail(raw []byte) (checkReport, error) {
+	report := checkReport{Errors: []string{}}
+
+	envelope, err := enmime.ReadEnvelope(bytes.NewReader(raw))
+	if err != nil {
+		return report, xerrors.Errorf("can not interprete mail: %w", err)
+	}
+
+	from, err := mail.ParseAddress(envelope.Root.Header.Get("from"))
+	if err != nil {
+		return report, xerrors.Errorf("can not interprete mail address: %w", err)
+	}
+
+	to := newRecipient(envelope.Root.Header, from)
+	report.From = from.String()
+	report.Language = to.lang
+	report.Automated = to.automated
+
+	b := selected
+	if b == nil {
+		if b, err = routeMail(envelope.Root.Header); err != nil {
+			return report, err
+		}
+	}
+	report.Board = b.String()
+
+	// Redis is only read. Without redis, only the rules from the config are
+	// used.
+	pool, err := newReadOnlyPool(cfg.Redis, b)
+	if err != nil {
+		report.Notes = append(report.Notes, fmt.Sprintf("redis is not available, sender rules from redis, duplicates and post limits are not checked: %v", err))
+	}
+
+	if pool != nil {
+		version, err := pool.storedSchemaVersion()
+		if err != nil {
+			return report, err
+		}
+		if version != currentSchema() {
+			report.Errors = append(report.Errors, fmt.Sprintf("The data has the schema version %d, but %d is required", version, currentSchema()))
+		}
+	}
+
+	rules := cfg.Senders.senderRules
+	if pool != nil {
+		if rules, err = pool.senderRules(); err != nil {
+			return report, err
+		}
+	}
+
+	report.Sender = "allowed"
+	if !rules.allowed(from.Address) {
+		report.Sender = "rejected"
+		report.Errors = append(report.Errors, senderRejectError().Error())
+	}
+
+	if cfg.Auth.enabled() {
+		result, err := authenticate(bytes.NewReader(raw), envelope.Root.Header, from.Address)
+		if err != nil {
+			return report, err
+		}
+
+		report.Auth = &checkAuth{Result: result, Action: cfg.Auth.action(result)}
+		if report.Auth.Action != "accept" {
+			report.Errors = append(report.Errors, fmt.Sprintf("Authentication result %s is not accepted", result))
+		}
+	}
+
+	subject, text, imageExt, image, lifetime, errs := parseMail(envelope)
+	report.Subject = subject
+	report.Text = text
+	if lifetime > 0 {
+		report.Lifetime = lifetime.String()
+	}
+	for _, err := range errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	if image != nil {
+		report.Image = &checkImage{Extension: imageExt, Size: len(image)}
+
+		decoded, err := imaging.Decode(bytes.NewReader(image))
+		if err != nil {
+			report.Errors = append(report.Errors, errParsingImage.Error())
+		} else {
+			report.Image.Width = decoded.Bounds().Dx()
+			report.Image.Height = decoded.Bounds().Dy()
+
+			if pool != nil && cfg.Duplicates.Action != "accept" {
+				id, err := pool.findDuplicate(imageHash(decoded))
+				if err != nil {
+					return report, err
+				}
+
+				if id != 0 {
+					report.Duplicate = id
+					report.Errors = append(report.Errors, newUserError(msgDuplicate, b.postURL(id)).Error())
+				}
+			}
+		}
+	}
+
+	if pool != nil {
+		statuses, until, exempt, err := pool.peekQuota(from.Address, time.Now())
+		if err != nil {
+			return report, err
+		}
+
+		report.Limits = statuses
+		if exempt {
+			report.Notes = append(report.Notes, "the sender is exempt from the post limits")
+		}
+		if !until.IsZero() {
+			report.Errors = append(report.Errors, newUserError(msgQuota, until).Error())
+		}
+	}
+
+	report.Valid = len(report.Errors) == 0
+	return report, nil
+}
+
+// writeCheckReport writes a report in a human readable form.
+func writeCheckReport(w io.Writer, r checkReport) {
+	fmt.Fprintf(w, "From:      %s\n", r.From)
+	fmt.Fprintf(w, "Board:     %s\n", r.Board)
+	fmt.Fprintf(w, "Subject:   %s\n", r.Subject)
+	fmt.Fprintf(w, "Text:      %s\n", r.Text)
+	if r.Lifetime != "" {
+		fmt.Fprintf(w, "Lifetime:  %s\n", r.Lifetime)
+	}
+	fmt.Fprintf(w, "Language:  %s\n", r.Language)
+	if r.Automated {
+		fmt.Fprintf(w, "Automated: yes, no response would be send\n")
+	}
+
+	if r.Image != nil {
+		fmt.Fprintf(w, "Image:     %s, %d bytes", r.Image.Extension, r.Image.Size)
+		if r.Image.Width > 0 {
+			fmt.Fprintf(w, ", %dx%d", r.Image.Width, r.Image.Height)
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintf(w, "Sender:    %s\n", r.Sender)
+	if r.Auth != nil {
+		fmt.Fprintf(w, "Auth:      %s (%s)\n", r.Auth.Result, r.Auth.Action)
+	}
+
+	for _, l := range r.Limits {
+		fmt.Fprintf(w, "Limit:     %s, %d of %d used\n", l.Limit, l.Used, l.Max)
+	}
+
+	for _, note := range r.Notes {
+		fmt.Fprintf(w, "Note:      %s\n", note)
+	}
+
+	if r.Valid {
+		fmt.Fprintln(w, "\nThe mail is valid.")
+		return
+	}
+
+	fmt.Fprintf(w, "\nThe mail is invalid:\n")
+	for _, err := range r.Errors {
+		fmt.Fprintf(w, "  - %s\n", strings.TrimSpace(err))
+	}
+}
@@ -0,0 +1,86 @@
+package mailimage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestCheckReportsLimits(t *testing.T) {
+	p := setupTest(t, "[duplicates]\naction = \"accept\"\n\n[limits]\naddress_per_hour = 1\n")
+	raw := testMail(t, "user@example.org", "")
+
+	report, err := checkMail(raw)
+	if err != nil {
+		t.Fatalf("checkMail returned error: %v", err)
+	}
+	if !report.Valid {
+		t.Fatalf("mail is invalid: %v", report.Errors)
+	}
+	if len(report.Limits) != 1 || report.Limits[0].Used != 0 || report.Limits[0].Max != 1 {
+		t.Fatalf("got limits %v, expected one unused limit", report.Limits)
+	}
+
+	// The check does not count
+	if _, _, err := p.useQuota("user@example.org", time.Now()); err != nil {
+		t.Fatalf("useQuota returned error: %v", err)
+	}
+
+	report, err = checkMail(raw)
+	if err != nil {
+		t.Fatalf("checkMail returned error: %v", err)
+	}
+	if report.Valid {
+		t.Errorf("mail over the limit is valid")
+	}
+	if len(report.Limits) != 1 || report.Limits[0].Used != 1 {
+		t.Errorf("got limits %v, expected one used post", report.Limits)
+	}
+}
+
+func TestCheckDoesNotWrite(t *testing.T) {
+	p := setupTest(t, "[duplicates]\naction = \"reject\"\n\n[limits]\naddress_per_hour = 1\n")
+
+	conn := p.Get()
+	defer conn.Close()
+
+	// setupTest saved the schema version of the empty database
+	if _, err := conn.Do("DEL", p.key("schema")); err != nil {
+		t.Fatalf("can not delete schema version: %v", err)
+	}
+
+	report, err := checkMail(testMail(t, "user@example.org", ""))
+	if err != nil {
+		t.Fatalf("checkMail returned error: %v", err)
+	}
+	if !report.Valid {
+		t.Errorf("mail is invalid: %v", report.Errors)
+	}
+
+	keys, err := redis.Strings(conn.Do("KEYS", p.key("*")))
+	if err != nil {
+		t.Fatalf("can not receive keys: %v", err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("check created the keys %v", keys)
+	}
+}
+
+func TestCheckReportsOldSchema(t *testing.T) {
+	p := setupTest(t, "[duplicates]\naction = \"accept\"\n")
+
+	conn := p.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", p.key("schema"), 1); err != nil {
+		t.Fatalf("can not set schema version: %v", err)
+	}
+
+	report, err := checkMail(testMail(t, "user@example.org", ""))
+	if err != nil {
+		t.Fatalf("checkMail returned error: %v", err)
+	}
+	if report.Valid {
+		t.Errorf("mail is valid with an old schema")
+	}
+}
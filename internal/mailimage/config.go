@@ -1,10 +1,18 @@
 package mailimage
 
-const (
-	redisAddr = ":6379"
-	smptHost  = "localhost"
-	smptPort  = 25
+import (
+	"os"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/xerrors"
+)
 
+// DefaultConfigPath is the path of the config file that is used, if no other
+// path is given. It is not an error, if this file does not exist.
+const DefaultConfigPath = "/etc/mailimage.toml"
+
+const (
 	tokenLength          = 8
 	tokenExpire          = 24 * 60 * 60
 	defaultMailimagePath = "/srv/mailimage/mails"
@@ -13,36 +21,231 @@ const (
 	baseURL              = "https://ernte.baarfood.de"
 	deleteRedirectURL    = "https://baarfood.de/ernte-teilen/"
 
-	fromAdress      = "Baarfood <ernte@baarfood.de>"
-	responseRegards = "Viele Grüße\nBaarfood"
+	fromAdress = "Baarfood <ernte@baarfood.de>"
+	boardName  = "Baarfood"
 )
 
-const sendErrorTemplate = `Hallo{{ if .Name }} {{ .Name }}{{ end }},
+var allowedFormats = [...]string{
+	"jpeg",
+	"png",
+	"jpg",
+}
 
-dein Bild kann nicht gespeichert werden. Bitte behebe {{ $length := len .Errors }}{{ if gt $length 1 }}den folgenden{{ else }}die folgenden{{ end }} Fehler:
-{{ range .Errors }}* {{ . }}
-{{ end }}
+// config contains all settings that can be changed with the config file.
+type config struct {
+	// Language is the language of the responses and the website, if the
+	// language of the user is unknown. Supported are "de" and "en".
+	Language string `toml:"language"`
 
-{{ .Regards }}
-`
+	// TemplateDir is a folder with templates that replace the embedded
+	// templates.
+	TemplateDir string `toml:"template_dir"`
 
-const sendSuccessTemplate = `Hallo {{ .Name }},
+	// AdminToken enables the admin api and the admin pages. Requests to the
+	// api have to send it in the header "Authorization: Bearer <token>", the
+	// pages ask for it as password.
+	AdminToken string `toml:"admin_token"`
 
-dein Bild wurde erfolgreich veröffentlicht. Über folgenden Link kannst du es
-aufrufen:
+	// PageSize is the number of images on one page of the website. 0 shows
+	// all images on one page.
+	PageSize int `toml:"page_size"`
 
-{{ .ImageLink }}
+	Senders senderConfig `toml:"senders"`
+	Auth    authConfig   `toml:"auth"`
+	Replies replyConfig  `toml:"replies"`
+	Limits  limitConfig  `toml:"limits"`
 
-In den folgenden 24 Stunden kannst du es mit einem klick auf den folgenden Link
-wieder löschen:
+	Duplicates duplicateConfig `toml:"duplicates"`
+	Mailer     mailerConfig    `toml:"mailer"`
+	Queue      queueConfig     `toml:"queue"`
+	Retention  retentionConfig `toml:"retention"`
+	Trash      trashConfig     `toml:"trash"`
+	Storage    storageConfig   `toml:"storage"`
+	Redis      redisConfig     `toml:"redis"`
+	Cache      cacheConfig     `toml:"cache"`
 
-{{ .RemoveLink }}
+	// Boards are the boards of this instance. Without boards, there is one
+	// board with the global settings.
+	Boards []boardConfig `toml:"boards"`
+}
 
-{{ .Regards }}
-`
+// senderConfig contains the rules which senders are allowed to post images.
+type senderConfig struct {
+	senderRules
 
-var allowedFormats = [...]string{
-	"jpeg",
-	"png",
-	"jpg",
+	// Reject defines what happens with mails from rejected senders. "reply"
+	// sends an error mail to the sender, "drop" silently drops the mail.
+	Reject string `toml:"reject"`
+
+	// RejectMessage is the error that is send to rejected senders. If it is
+	// empty, a default message is used.
+	RejectMessage string `toml:"reject_message"`
+}
+
+// replyConfig contains the settings for the responses to incoming mails.
+type replyConfig struct {
+	// RateLimit is the maximum number of error responses that are send to one
+	// address per hour. 0 means no limit.
+	RateLimit int `toml:"rate_limit"`
+}
+
+// cfg holds the current configuration. It is replaced by LoadConfig.
+var cfg = defaultConfig()
+
+func defaultConfig() config {
+	return config{
+		Language: "de",
+		PageSize: 50,
+		Senders: senderConfig{
+			Reject: "reply",
+		},
+		Auth: authConfig{
+			Fail: "accept",
+			None: "accept",
+		},
+		Replies: replyConfig{
+			RateLimit: 10,
+		},
+		Duplicates: duplicateConfig{
+			Action:   "reject",
+			Distance: 4,
+			Recent:   100,
+		},
+		Mailer: mailerConfig{
+			Type: "smtp",
+			Host: "localhost",
+			Port: 25,
+			TLS:  "none",
+		},
+		Queue: queueConfig{
+			Interval: 10 * time.Second,
+			RetryMin: time.Minute,
+			RetryMax: time.Hour,
+			MaxAge:   48 * time.Hour,
+		},
+		Retention: retentionConfig{
+			Action:   "delete",
+			Interval: time.Hour,
+		},
+		Trash: trashConfig{
+			Keep: 7 * 24 * time.Hour,
+		},
+		Storage: storageConfig{
+			Type:      "file",
+			URLExpiry: 15 * time.Minute,
+		},
+		Redis: redisConfig{
+			URL:            "redis://localhost:6379",
+			Prefix:         "mailimage",
+			ConnectTimeout: 5 * time.Second,
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   10 * time.Second,
+		},
+	}
+}
+
+// LoadConfig reads the config file at path and loads the templates. Values that
+// are not set in the file keep their default values. If path is the
+// DefaultConfigPath and the file does not exist, the default config is used.
+func LoadConfig(path string) error {
+	c := defaultConfig()
+	if _, err := toml.DecodeFile(path, &c); err != nil {
+		if !os.IsNotExist(err) || path != DefaultConfigPath {
+			return xerrors.Errorf("can not read config file %s: %w", path, err)
+		}
+	}
+
+	if _, ok := catalog[c.Language]; !ok {
+		return xerrors.Errorf("unsupported language: %s", c.Language)
+	}
+
+	if c.PageSize < 0 {
+		return xerrors.New("page_size can not be negative")
+	}
+
+	switch c.Senders.Reject {
+	case "reply", "drop":
+	default:
+		return xerrors.Errorf("invalid value for senders.reject: %s", c.Senders.Reject)
+	}
+
+	switch c.Duplicates.Action {
+	case "accept", "quarantine", "reject":
+	default:
+		return xerrors.Errorf("invalid value for duplicates.action: %s", c.Duplicates.Action)
+	}
+
+	switch c.Retention.Action {
+	case "delete", "archive":
+	default:
+		return xerrors.Errorf("invalid value for retention.action: %s", c.Retention.Action)
+	}
+
+	for name, value := range map[string]string{"auth.fail": c.Auth.Fail, "auth.none": c.Auth.None} {
+		switch value {
+		case "accept", "quarantine", "reject":
+		default:
+			return xerrors.Errorf("invalid value for %s: %s", name, value)
+		}
+	}
+
+	for name, value := range map[string]time.Duration{"queue.interval": c.Queue.Interval, "queue.retry_min": c.Queue.RetryMin, "queue.retry_max": c.Queue.RetryMax} {
+		if value <= 0 {
+			return xerrors.Errorf("%s has to be positive", name)
+		}
+	}
+
+	if c.Retention.Interval <= 0 {
+		return xerrors.New("retention.interval has to be positive")
+	}
+
+	if c.Trash.Keep < 0 {
+		return xerrors.New("trash.keep can not be negative")
+	}
+
+	if c.Retention.MaxAge < 0 || c.Retention.MaxEntries < 0 || c.Retention.NotifyBefore < 0 {
+		return xerrors.New("retention.max_age, retention.max_entries and retention.notify_before can not be negative")
+	}
+
+	if _, err := c.Redis.target(); err != nil {
+		return err
+	}
+
+	if c.Redis.Prefix == "" {
+		return xerrors.New("redis.prefix can not be empty")
+	}
+
+	if len(c.Redis.Sentinels) > 0 && c.Redis.SentinelMaster == "" {
+		return xerrors.New("redis.sentinel_master is required with redis.sentinels")
+	}
+
+	if c.Redis.ConnectTimeout < 0 || c.Redis.ReadTimeout < 0 || c.Redis.WriteTimeout < 0 {
+		return xerrors.New("redis.connect_timeout, redis.read_timeout and redis.write_timeout can not be negative")
+	}
+
+	if c.Storage.URLExpiry <= 0 {
+		return xerrors.New("storage.url_expiry has to be positive")
+	}
+
+	m, err := newMailer(c.Mailer)
+	if err != nil {
+		return err
+	}
+
+	b, err := newBoards(c)
+	if err != nil {
+		return err
+	}
+
+	for _, board := range b {
+		if err := board.loadTemplates(); err != nil {
+			return xerrors.Errorf("can not load templates of board %s: %w", board, err)
+		}
+	}
+
+	cfg = c
+	outbound = m
+	boards = b
+	selected = nil
+	return nil
 }
@@ -2,13 +2,20 @@ package mailimage
 
 import "golang.org/x/xerrors"
 
-func Delete(id int) error {
-	pool, err := newPool(redisAddr)
+// Delete moves an entry into the trash. If permanent is true, it is deleted
+// immediately.
+func Delete(id int, permanent bool) error {
+	pool, err := newPool(cfg.Redis)
 	if err != nil {
 		return xerrors.Errorf("Can not create redis pool: %w", err)
 	}
 
-	if err = pool.deleteFromID(id); err != nil {
+	del := pool.trashEntry
+	if permanent {
+		del = pool.deleteFromID
+	}
+
+	if err = del(id); err != nil {
 		return xerrors.Errorf("Can not delete image: %w", err)
 	}
 	return nil
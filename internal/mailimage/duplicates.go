@@ -0,0 +1,210 @@
+package mailimage
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// duplicateConfig contains the settings for the detection of images that where
+// already posted.
+type duplicateConfig struct {
+	// Action defines what happens with a duplicate image. "reject" sends an
+	// error mail to the sender, "quarantine" moves the mail into the
+	// quarantine folder and "accept" disables the detection.
+	Action string `toml:"action"`
+
+	// Distance is the maximum number of different bits between the hashes of
+	// two images so that they are seen as equal.
+	Distance int `toml:"distance"`
+
+	// Recent is the number of the last entries that are compared with a new
+	// image.
+	Recent int `toml:"recent"`
+}
+
+// imageHash calculates the difference hash (dHash) of an image. Similar images
+// have hashes with a small hamming distance.
+func imageHash(img image.Image) uint64 {
+	img = imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left, _, _, _ := img.At(x, y).RGBA()
+			right, _, _, _ := img.At(x+1, y).RGBA()
+
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashDistance returns the number of different bits between two hashes.
+func hashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// setImageHash saves the hash of an image to its entry.
+func (p *pool) setImageHash(id int, hash uint64) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", p.key("entry", strconv.Itoa(id)), "phash", strconv.FormatUint(hash, 16)); err != nil {
+		return xerrors.Errorf("can not save image hash of entry %d: %w", id, err)
+	}
+	return nil
+}
+
+// imageHashes returns the image hashes of the given entries. Entries without a
+// hash and entries in the trash are not in the returned map, because nobody
+// can see them.
+func (p *pool) imageHashes(ids []int) (map[int]uint64, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		if err := conn.Send("HMGET", p.key("entry", strconv.Itoa(id)), "phash", "deleted"); err != nil {
+			return nil, xerrors.Errorf("can not request image hash: %w", err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, xerrors.Errorf("can not request image hashes: %w", err)
+	}
+
+	hashes := make(map[int]uint64)
+	for _, id := range ids {
+		values, err := redis.Strings(conn.Receive())
+		if err != nil {
+			return nil, xerrors.Errorf("can not receive image hash of entry %d: %w", id, err)
+		}
+		if values[0] == "" || values[1] != "" {
+			continue
+		}
+
+		hash, err := strconv.ParseUint(values[0], 16, 64)
+		if err != nil {
+			return nil, xerrors.Errorf("invalid image hash of entry %d: %w", id, err)
+		}
+		hashes[id] = hash
+	}
+	return hashes, nil
+}
+
+// findDuplicate compares a hash with the hashes of the recent entries. Returns
+// the id of a similar image or 0.
+func (p *pool) findDuplicate(hash uint64) (int, error) {
+	conn := p.Get()
+	lastID, err := redis.Int(conn.Do("GET", p.key("last_id")))
+	conn.Close()
+	if err != nil && err != redis.ErrNil {
+		return 0, xerrors.Errorf("can not get last id: %w", err)
+	}
+
+	var ids []int
+	for id := lastID; id > 0 && id > lastID-cfg.Duplicates.Recent; id-- {
+		ids = append(ids, id)
+	}
+
+	hashes, err := p.imageHashes(ids)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		other, ok := hashes[id]
+		if ok && hashDistance(hash, other) <= cfg.Duplicates.Distance {
+			return id, nil
+		}
+	}
+	return 0, nil
+}
+
+// Dedupe writes all similar images in the database to w.
+//
+// Images without a hash are hashed first.
+func Dedupe(w io.Writer, distance int) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	entries, err := pool.listEntries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	ids := make([]int, len(entries))
+	for i, e := range entries {
+		ids[i] = e.ID
+	}
+
+	hashes, err := pool.imageHashes(ids)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if _, ok := hashes[e.ID]; ok {
+			continue
+		}
+
+		hash, err := pool.hashImageFile(e.Blob)
+		if err != nil {
+			fmt.Fprintf(w, "can not hash image %d: %v\n", e.ID, err)
+			continue
+		}
+
+		if err := pool.setImageHash(e.ID, hash); err != nil {
+			return err
+		}
+		hashes[e.ID] = hash
+	}
+
+	for i, e := range entries {
+		hash, ok := hashes[e.ID]
+		if !ok {
+			continue
+		}
+
+		for _, other := range entries[:i] {
+			otherHash, ok := hashes[other.ID]
+			if !ok {
+				continue
+			}
+
+			if d := hashDistance(hash, otherHash); d <= distance {
+				fmt.Fprintf(w, "%d is a duplicate of %d (distance %d)\n", e.ID, other.ID, d)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// hashImageFile calculates the hash of an image in the blob store.
+func (b *board) hashImageFile(blob string) (uint64, error) {
+	f, err := b.openImage(blob)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, err := imaging.Decode(f)
+	if err != nil {
+		return 0, xerrors.Errorf("can not decode image: %w", err)
+	}
+
+	return imageHash(img), nil
+}
@@ -0,0 +1,162 @@
+package mailimage
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// EntryUpdate contains the new values of an entry. Nil fields are not changed.
+type EntryUpdate struct {
+	Subject *string `json:"subject"`
+	Text    *string `json:"text"`
+	From    *string `json:"from"`
+}
+
+// fields returns the changed fields with the names of the redis hash.
+func (u EntryUpdate) fields() map[string]string {
+	fields := make(map[string]string)
+	if u.Subject != nil {
+		fields["subject"] = strings.TrimSpace(*u.Subject)
+	}
+	if u.Text != nil {
+		fields["text"] = strings.TrimSpace(*u.Text)
+	}
+	if u.From != nil {
+		fields["from"] = strings.TrimSpace(*u.From)
+	}
+	return fields
+}
+
+// validate checks the new values with the same rules as incoming mails.
+func (u EntryUpdate) validate() error {
+	fields := u.fields()
+	if len(fields) == 0 {
+		return xerrors.New("nothing to change")
+	}
+
+	if len(fields["subject"]) > subjectLength {
+		return errLongSubject
+	}
+
+	if len(fields["text"]) > textLength {
+		return errLongText
+	}
+
+	if from, ok := fields["from"]; ok && from == "" {
+		return xerrors.New("the sender name can not be empty")
+	}
+	return nil
+}
+
+// entryEdit is one change of a field in the edit history of an entry.
+type entryEdit struct {
+	Time  time.Time `json:"time"`
+	Field string    `json:"field"`
+	Old   string    `json:"old"`
+	New   string    `json:"new"`
+}
+
+// updateEntry changes fields of an entry and saves the old values in the edit
+// history of the entry.
+func (p *pool) updateEntry(id int, u EntryUpdate) error {
+	if err := u.validate(); err != nil {
+		return err
+	}
+
+	entryKey := p.key("entry", strconv.Itoa(id))
+	fields := u.fields()
+
+	conn := p.Get()
+	defer conn.Close()
+
+	// Watch the entry, so no other update is lost
+	if _, err := conn.Do("WATCH", entryKey); err != nil {
+		return xerrors.Errorf("can not watch entry %d: %w", id, err)
+	}
+
+	if _, err := p.getEntry(id); err != nil {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	now := time.Now()
+	var edits []interface{}
+	args := []interface{}{entryKey}
+	for _, field := range []string{"subject", "text", "from"} {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+
+		old, err := redis.String(conn.Do("HGET", entryKey, field))
+		if err != nil && err != redis.ErrNil {
+			conn.Do("UNWATCH")
+			return xerrors.Errorf("can not receive %s of entry %d: %w", field, id, err)
+		}
+
+		if old == value {
+			continue
+		}
+
+		edit, err := json.Marshal(entryEdit{Time: now, Field: field, Old: old, New: value})
+		if err != nil {
+			conn.Do("UNWATCH")
+			return xerrors.Errorf("can not encode edit: %w", err)
+		}
+		edits = append(edits, edit)
+		args = append(args, field, value)
+	}
+
+	if len(edits) == 0 {
+		conn.Do("UNWATCH")
+		return nil
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HMSET", args...)
+	conn.Send("RPUSH", append([]interface{}{p.key("entry", strconv.Itoa(id), "history")}, edits...)...)
+	conn.Send("INCR", p.generationKey())
+	reply, err := conn.Do("EXEC")
+	if err != nil {
+		return xerrors.Errorf("can not update entry %d: %w", id, err)
+	}
+
+	if reply == nil {
+		return xerrors.Errorf("entry %d was changed at the same time", id)
+	}
+	return nil
+}
+
+// entryHistory returns all edits of an entry, the oldest first.
+func (p *pool) entryHistory(id int) ([]entryEdit, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	values, err := redis.ByteSlices(conn.Do("LRANGE", p.key("entry", strconv.Itoa(id), "history"), 0, -1))
+	if err != nil {
+		return nil, xerrors.Errorf("can not receive history of entry %d: %w", id, err)
+	}
+
+	edits := make([]entryEdit, len(values))
+	for i, value := range values {
+		if err := json.Unmarshal(value, &edits[i]); err != nil {
+			return nil, xerrors.Errorf("can not decode history of entry %d: %w", id, err)
+		}
+	}
+	return edits, nil
+}
+
+// UpdateEntry changes the subject, the text or the sender name of an entry.
+func UpdateEntry(id int, u EntryUpdate) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	return pool.updateEntry(id, u)
+}
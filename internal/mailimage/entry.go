@@ -1,16 +1,44 @@
 package mailimage
 
+import (
+	"fmt"
+	"time"
+)
+
 type entry struct {
 	ID        int
 	From      string
+	Mail      string
 	Subject   string
 	Text      string
 	Extension string
 	Created   string
+	Date      time.Time
+
+	// Expires is the lifetime that was set by the sender. It is the zero
+	// time, if the sender did not set a lifetime.
+	Expires time.Time
+
+	// Blob is the hash of the image in the blob store.
+	Blob string
 }
 
-type byCreated []entry
+// ImageFile returns the path of the image below /image/. It contains the hash
+// of the image, so it changes, when the image changes.
+func (e entry) ImageFile() string {
+	return fmt.Sprintf("%d/%s%s", e.ID, e.Blob, e.Extension)
+}
 
-func (a byCreated) Len() int           { return len(a) }
-func (a byCreated) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a byCreated) Less(i, j int) bool { return a[i].Created < a[j].Created }
+// imageName returns the name of the image in the store. Entries that are not
+// migrated to the blob store use the old name.
+func (e entry) imageName() string {
+	if e.Blob == "" {
+		return legacyImageNames(e.ID, e.Extension)[0]
+	}
+	return blobName(e.Blob)
+}
+
+// ThumbnailFile returns the path of the thumbnail below /thumbnail/.
+func (e entry) ThumbnailFile() string {
+	return fmt.Sprintf("%d/%s.jpg", e.ID, e.Blob)
+}
@@ -1,17 +1,50 @@
 package mailimage
 
 import (
-	"fmt"
-
 	"golang.org/x/xerrors"
 )
 
 var (
-	errNoImage      = xerrors.New("Keine Bilddatei in der E-Mail gefunden.")
-	errMultiImage   = xerrors.New("Mehrere Bilder gefunden. Die E-Mail darf maximal ein Bild entalten.")
-	errParsingImage = xerrors.New("Die Bilddatei kann nicht gelesen werden.")
-	errLongSubject  = xerrors.New(fmt.Sprintf("E-Mail Betreff ist zu lang. Maximal %d zeichen sind erlaubt.", subjectLength))
-	errLongText     = xerrors.New(fmt.Sprintf("Text der E-Mail darf maximal %d Zeichen lang sein.", textLength))
-	errInternal     = xerrors.New("Ups, etwas ist schief gelaufen. Bitte die Admins benachrichtigen.")
-	errUnknownImage = xerrors.New("Unknown image id")
+	errNoImage        = newUserError(msgNoImage)
+	errMultiImage     = newUserError(msgMultiImage)
+	errParsingImage   = newUserError(msgParsingImage)
+	errLongSubject    = newUserError(msgLongSubject, subjectLength)
+	errLongText       = newUserError(msgLongText, textLength)
+	errInternal       = newUserError(msgInternal)
+	errSenderRejected = newUserError(msgSenderRejected)
+	errUnknownImage   = xerrors.New("Unknown image id")
+
+	// errMethodNotAllowed is returned by a handler of the website, if the
+	// request has the wrong method. The handler sets the Allow header.
+	errMethodNotAllowed = xerrors.New("Method not allowed")
 )
+
+// userError is an error that is send to the user. It is rendered with the
+// message catalog in the language of the user.
+type userError struct {
+	key  msgKey
+	args []interface{}
+}
+
+func newUserError(key msgKey, args ...interface{}) *userError {
+	return &userError{key: key, args: args}
+}
+
+func (e *userError) Error() string {
+	return e.localize("en")
+}
+
+// localize returns the error message in the given language.
+func (e *userError) localize(lang string) string {
+	return translate(lang, e.key, e.args...)
+}
+
+// localizeError returns the message of an error in the given language. Errors
+// that are not userErrors are not translated.
+func localizeError(err error, lang string) string {
+	var uerr *userError
+	if xerrors.As(err, &uerr) {
+		return uerr.localize(lang)
+	}
+	return err.Error()
+}
@@ -1,10 +1,13 @@
 package mailimage
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path"
+	"path/filepath"
 	"time"
 
 	"github.com/disintegration/imaging"
@@ -21,17 +24,23 @@ func mailimagePath() string {
 
 type mailFile struct {
 	*os.File
+	board  *board
 	name   string
 	folder string
 }
 
-// Create creates a new mailFile with the date as the name
-func newMailFile() (*mailFile, error) {
+// Create creates a new mailFile of a board with the date as the name
+func newMailFile(b *board) (*mailFile, error) {
 	f := mailFile{
-		name:   fmt.Sprintf("%s-%02d.eml", time.Now().Format("2006-01-02_15-04-05"), rand.Intn(99)),
+		board:  b,
+		name:   newMailName(),
 		folder: "progress",
 	}
 
+	if err := os.MkdirAll(path.Join(b.path, f.folder), os.ModePerm); err != nil {
+		return nil, xerrors.Errorf("can not create progress folder: %w", err)
+	}
+
 	fi, err := os.Create(f.path())
 	if err != nil {
 		return nil, xerrors.Errorf("can not open image file for writing: %w", err)
@@ -40,13 +49,51 @@ func newMailFile() (*mailFile, error) {
 	return &f, nil
 }
 
-// move moves the file from one folder to another
-func (f *mailFile) move(folder string) error {
-	if err := os.MkdirAll(path.Join(mailimagePath(), folder), os.ModePerm); err != nil {
-		return xerrors.Errorf("can not create folder %s: %w", folder, err)
+// newMailName returns a name for a new mail file with the date.
+func newMailName() string {
+	return fmt.Sprintf("%s-%02d.eml", time.Now().Format("2006-01-02_15-04-05"), rand.Intn(99))
+}
+
+// unroutedFolder is the folder below MAILIMAGE_PATH for mails that do not
+// belong to any board. It is on the local disk, because there is no board
+// and therefore no store.
+const unroutedFolder = "unrouted"
+
+// saveUnrouted saves a mail that does not belong to any board into the
+// unrouted folder. It can be reprocessed into a board with
+// `mailimage --board <name> reprocess <path>`.
+func saveUnrouted(in io.Reader) (string, error) {
+	folder := filepath.Join(mailimagePath(), unroutedFolder)
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return "", xerrors.Errorf("can not create unrouted folder: %w", err)
+	}
+
+	name := filepath.Join(folder, newMailName())
+	f, err := os.Create(name)
+	if err != nil {
+		return "", xerrors.Errorf("can not open unrouted mail for writing: %w", err)
 	}
 
-	if err := os.Rename(f.path(), path.Join(mailimagePath(), folder, f.name)); err != nil {
+	if _, err := io.Copy(f, in); err != nil {
+		f.Close()
+		return "", xerrors.Errorf("can not save unrouted mail: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return "", xerrors.Errorf("can not save unrouted mail: %w", err)
+	}
+	return name, nil
+}
+
+// move moves the file from one folder to another. The folder progress is
+// always on the local disk, all other folders are in the store.
+func (f *mailFile) move(folder string) error {
+	var err error
+	if f.folder == "progress" {
+		err = f.board.store.put(f.path(), path.Join(folder, f.name))
+	} else {
+		err = f.board.store.rename(path.Join(f.folder, f.name), path.Join(folder, f.name))
+	}
+	if err != nil {
 		return xerrors.Errorf("can not move mail from %s to %s: %w", f.folder, folder, err)
 	}
 
@@ -54,9 +101,15 @@ func (f *mailFile) move(folder string) error {
 	return nil
 }
 
-// remove changes the name of the file.
+// rename changes the name of the file.
 func (f *mailFile) rename(name string) error {
-	if err := os.Rename(f.path(), path.Join(mailimagePath(), f.folder, name)); err != nil {
+	var err error
+	if f.folder == "progress" {
+		err = os.Rename(f.path(), path.Join(f.board.path, f.folder, name))
+	} else {
+		err = f.board.store.rename(path.Join(f.folder, f.name), path.Join(f.folder, name))
+	}
+	if err != nil {
 		return xerrors.Errorf("can not rename mail from %s to %s: %w", f.name, name, err)
 	}
 
@@ -64,47 +117,52 @@ func (f *mailFile) rename(name string) error {
 	return nil
 }
 
-// path returns the full path of the file (including the name of the file)
+// path returns the full path of the file (including the name of the file) on
+// the local disk.
 func (f *mailFile) path() string {
-	return path.Join(mailimagePath(), f.folder, f.name)
+	return path.Join(f.board.path, f.folder, f.name)
 }
 
-func openImage(id int, ext string) (*os.File, error) {
-	path := path.Join(mailimagePath(), "images", fmt.Sprintf("%d%s", id, ext))
-	f, err := os.Open(path)
+// openImage opens the image of a blob.
+func (b *board) openImage(blob string) (io.ReadCloser, error) {
+	if blob == "" {
+		return nil, errUnknownImage
+	}
+
+	f, err := b.store.open(blobName(blob))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, errUnknownImage
 		}
-		return nil, xerrors.Errorf("can not open image %d%s: %s", id, ext, err)
+		return nil, xerrors.Errorf("can not open image %s: %s", blob, err)
 	}
 	return f, nil
 }
 
-func openThumbnail(id int, redis *pool) (*os.File, error) {
-	path := path.Join(mailimagePath(), "thumbnail", fmt.Sprintf("%d.jpg", id))
-	f, err := os.Open(path)
+// openThumbnail opens the thumbnail of a blob. It is created, if it does not
+// exist.
+func (b *board) openThumbnail(blob string) (io.ReadCloser, error) {
+	if blob == "" {
+		return nil, errUnknownImage
+	}
+
+	f, err := b.store.open(thumbnailName(blob))
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err := createThumbnail(id, redis); err != nil {
+			if err := b.createThumbnail(blob); err != nil {
 				return nil, err
 			}
-			return openThumbnail(id, redis)
+			return b.openThumbnail(blob)
 		}
 		return nil, xerrors.Errorf("can not open thumbnail: %w", err)
 	}
 	return f, nil
 }
 
-func createThumbnail(id int, redis *pool) error {
-	ext, err := redis.getExtension(id)
-	if err != nil {
-		return err
-	}
-
-	f, err := openImage(id, ext)
+func (b *board) createThumbnail(blob string) error {
+	f, err := b.openImage(blob)
 	if err != nil {
-		return xerrors.Errorf("can not open image %s%ext: %w", id, ext, err)
+		return xerrors.Errorf("can not open image %s: %w", blob, err)
 	}
 
 	image, err := imaging.Decode(f)
@@ -117,17 +175,12 @@ func createThumbnail(id int, redis *pool) error {
 	// scale image
 	image = imaging.Fill(image, 250, 200, imaging.Center, imaging.Lanczos)
 
-	if err := os.MkdirAll(path.Join(mailimagePath(), "thumbnail"), os.ModePerm); err != nil {
-		return xerrors.Errorf("can not create folder thumbnail: %w", err)
-	}
-
-	f, err = os.Create(path.Join(mailimagePath(), "thumbnail", fmt.Sprintf("%d.jpg", id)))
-	if err != nil {
-		return xerrors.Errorf("can not create thumbnail: %w", err)
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, image, imaging.JPEG); err != nil {
+		return xerrors.Errorf("can not encode thumbnail: %w", err)
 	}
-	defer f.Close()
 
-	if err := imaging.Encode(f, image, imaging.JPEG); err != nil {
+	if err := b.store.write(thumbnailName(blob), buf.Bytes()); err != nil {
 		return xerrors.Errorf("can not write thumbnail: %w", err)
 	}
 	return nil
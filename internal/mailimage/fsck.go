@@ -0,0 +1,381 @@
+package mailimage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// fsckProblem is an inconsistency that was found by Fsck.
+type fsckProblem struct {
+	description string
+
+	// repair fixes the problem. It is nil, if the problem can not be fixed
+	// automatically.
+	repair func() error
+}
+
+// Fsck checks that the entries in redis and the files on disk match and writes
+// all problems to w. If repair is true, the problems are fixed. Returns the
+// number of problems that are not fixed.
+func Fsck(w io.Writer, repair bool) (int, error) {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return 0, xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	problems, err := pool.fsck()
+	if err != nil {
+		return 0, err
+	}
+
+	var left int
+	for _, problem := range problems {
+		switch {
+		case !repair:
+			fmt.Fprintf(w, "%s\n", problem.description)
+			left++
+
+		case problem.repair == nil:
+			fmt.Fprintf(w, "%s: can not be repaired\n", problem.description)
+			left++
+
+		default:
+			if err := problem.repair(); err != nil {
+				fmt.Fprintf(w, "%s: repair failed: %v\n", problem.description, err)
+				left++
+				continue
+			}
+			fmt.Fprintf(w, "%s: repaired\n", problem.description)
+		}
+	}
+
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "No problems found")
+	}
+	return left, nil
+}
+
+// fsck returns all inconsistencies between redis and the files on disk.
+func (p *pool) fsck() ([]fsckProblem, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	members, err := redis.Ints(conn.Do("ZRANGE", p.key("entries"), 0, -1))
+	if err != nil {
+		return nil, xerrors.Errorf("can not receive ids: %w", err)
+	}
+
+	listed := make(map[int]bool)
+	for _, id := range members {
+		listed[id] = true
+	}
+
+	trashedIDs, err := redis.Ints(conn.Do("ZRANGE", p.key("trash"), 0, -1))
+	if err != nil {
+		return nil, xerrors.Errorf("can not receive trash: %w", err)
+	}
+
+	trashed := make(map[int]bool)
+	for _, id := range trashedIDs {
+		trashed[id] = true
+	}
+
+	// ids and extensions of all entry hashes
+	hashes, err := p.entryKeys("")
+	if err != nil {
+		return nil, err
+	}
+
+	histories, err := p.entryKeys("history")
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []fsckProblem
+	add := func(repair func() error, format string, args ...interface{}) {
+		problems = append(problems, fsckProblem{description: fmt.Sprintf(format, args...), repair: repair})
+	}
+
+	extensions := make(map[int]string)
+	blobs := make(map[int]string)
+	refs := make(map[string]int)
+	for _, id := range sortedIDs(hashes) {
+		values, err := redis.Strings(conn.Do("HMGET", p.key("entry", strconv.Itoa(id)), "fileext", "blob"))
+		if err != nil {
+			return nil, xerrors.Errorf("can not get image of entry %d: %w", id, err)
+		}
+		extensions[id], blobs[id] = values[0], values[1]
+		if values[1] != "" {
+			refs[values[1]]++
+		}
+	}
+
+	for _, id := range members {
+		if _, ok := hashes[id]; !ok {
+			id := id
+			add(func() error { return p.removeEntry(id) }, "entry %d: listed, but has no data", id)
+		}
+	}
+
+	for _, id := range sortedIDs(histories) {
+		if _, ok := hashes[id]; !ok {
+			id := id
+			add(func() error { return p.removeEntry(id) }, "entry %d: edit history without entry", id)
+		}
+	}
+
+	for _, id := range sortedIDs(hashes) {
+		id := id
+		ext, blob := extensions[id], blobs[id]
+		if trashed[id] {
+			// The mails of entries in the trash are in the trash folder
+			continue
+		}
+		removeEntry := func() error { return p.removeBrokenEntry(id, ext) }
+
+		// Images from attachments without a file name have no extension
+		if ext != "" && !isAllowedExtension(ext) {
+			add(removeEntry, "entry %d: bad image extension %q", id, ext)
+			continue
+		}
+
+		if blob == "" {
+			add(func() error { return p.migrateBlob(id) }, "entry %d: image is not in the blob store", id)
+			continue
+		}
+
+		if _, err := p.store.stat(blobName(blob)); err != nil {
+			add(removeEntry, "entry %d: image %s is missing", id, blobName(blob))
+			continue
+		}
+
+		if _, err := p.hashImageFile(blob); err != nil {
+			add(removeEntry, "entry %d: image can not be decoded: %v", id, err)
+			continue
+		}
+
+		if !listed[id] {
+			add(func() error {
+				created, err := p.entryCreated(id)
+				if err != nil {
+					return err
+				}
+
+				conn := p.Get()
+				defer conn.Close()
+
+				if _, err := conn.Do("ZADD", p.key("entries"), created.Unix(), id); err != nil {
+					return err
+				}
+				return p.entriesChanged(conn)
+			}, "entry %d: not listed", id)
+		}
+
+		if _, err := p.store.stat(path.Join("success", strconv.Itoa(id))); err != nil {
+			add(nil, "entry %d: mail is missing", id)
+		}
+	}
+
+	// Reference counters of the blobs
+	counted, err := p.blobRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range sortedBlobs(refs, counted) {
+		hash := hash
+		if refs[hash] == counted[hash] {
+			continue
+		}
+
+		add(func() error {
+			conn := p.Get()
+			defer conn.Close()
+
+			if refs[hash] == 0 {
+				_, err := conn.Do("HDEL", p.key("blobs"), hash)
+				return err
+			}
+			_, err := conn.Do("HSET", p.key("blobs"), hash, refs[hash])
+			return err
+		}, "blob %s: %d references counted, but used by %d entries", hash, counted[hash], refs[hash])
+	}
+
+	// Blobs and thumbnails without entry
+	for _, folder := range []string{"blobs", "thumbnails"} {
+		infos, err := p.store.list(folder)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			if refs[strings.TrimSuffix(path.Base(info.name), ".jpg")] > 0 {
+				continue
+			}
+
+			name := info.name
+			add(func() error { return p.store.remove(name) }, "%s: file without entry", name)
+		}
+	}
+
+	// Files on disk without entry. The folders images and thumbnail are only
+	// used by entries that are not migrated to the blob store.
+	folders := []struct {
+		name string
+		file func(id int) string
+	}{
+		{"images", func(id int) string { return legacyFile(id, blobs[id], fmt.Sprintf("%d%s", id, extensions[id])) }},
+		{"thumbnail", func(id int) string { return legacyFile(id, blobs[id], fmt.Sprintf("%d.jpg", id)) }},
+		{"success", func(id int) string { return strconv.Itoa(id) }},
+	}
+
+	for _, folder := range folders {
+		infos, err := p.store.list(folder.name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			file := info.name
+			name := path.Base(file)
+			id, _ := strconv.Atoi(strings.TrimSuffix(name, path.Ext(name)))
+			if hashes[id] && file == path.Join(folder.name, folder.file(id)) {
+				continue
+			}
+
+			repair := func() error { return p.store.remove(file) }
+			if folder.name == "success" {
+				// Keep the mail, so it can be reprocessed
+				repair = func() error {
+					f := mailFile{board: p.board, name: name, folder: "success"}
+					return f.move("error")
+				}
+			}
+			add(repair, "%s: file without entry", file)
+		}
+	}
+	return problems, nil
+}
+
+// removeBrokenEntry removes an entry whose image is broken. The mail is moved
+// from the success folder to the error folder, so it can be reprocessed.
+func (p *pool) removeBrokenEntry(id int, ext string) error {
+	if err := p.unlinkBlob(id); err != nil {
+		return err
+	}
+
+	if err := p.removeEntry(id); err != nil {
+		return err
+	}
+
+	if ext != "" {
+		// The image of an entry that is not migrated to the blob store
+		for _, name := range legacyImageNames(id, ext) {
+			if err := p.store.remove(name); err != nil {
+				return xerrors.Errorf("can not delete %s from the store: %w", name, err)
+			}
+		}
+	}
+
+	f := mailFile{board: p.board, name: strconv.Itoa(id), folder: "success"}
+	if _, err := p.store.stat(path.Join(f.folder, f.name)); os.IsNotExist(err) {
+		return nil
+	}
+	return f.move("error")
+}
+
+// entryKeys returns the ids of all redis keys of entries with the given
+// suffix. An empty suffix returns the entry hashes.
+func (p *pool) entryKeys(suffix string) (map[int]bool, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	pattern := p.key("entry", "*")
+	if suffix != "" {
+		pattern = p.key("entry", "*", suffix)
+	}
+
+	ids := make(map[int]bool)
+	cursor := 0
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return nil, xerrors.Errorf("can not scan entries: %w", err)
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return nil, xerrors.Errorf("can not scan entries: %w", err)
+		}
+
+		for _, k := range keys {
+			parts := strings.Split(strings.TrimPrefix(k, p.key("entry", "")), ":")
+			if (suffix == "" && len(parts) != 1) || (suffix != "" && len(parts) != 2) {
+				continue
+			}
+
+			id, err := strconv.Atoi(parts[0])
+			if err != nil {
+				continue
+			}
+			ids[id] = true
+		}
+
+		if cursor == 0 {
+			return ids, nil
+		}
+	}
+}
+
+// sortedIDs returns the keys of the map in ascending order.
+func sortedIDs(ids map[int]bool) []int {
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+	return sorted
+}
+
+// legacyFile returns name, if the entry is not migrated to the blob store.
+func legacyFile(id int, blob, name string) string {
+	if blob != "" {
+		return ""
+	}
+	return name
+}
+
+// sortedBlobs returns the keys of both maps in ascending order.
+func sortedBlobs(a, b map[string]int) []string {
+	seen := make(map[string]bool)
+	var hashes []string
+	for _, m := range []map[string]int{a, b} {
+		for hash := range m {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// isAllowedExtension returns true, if ext is the extension of a supported
+// image format.
+func isAllowedExtension(ext string) bool {
+	for _, format := range allowedFormats {
+		if strings.EqualFold(ext, "."+format) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package mailimage
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestFsckKeepsMailOfBrokenEntry(t *testing.T) {
+	p := setupTest(t, "[duplicates]\naction = \"accept\"\n")
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board, noReply: true})
+	if err != nil {
+		t.Fatalf("insert returned error: %v", err)
+	}
+
+	e, err := p.getEntry(result.id)
+	if err != nil {
+		t.Fatalf("can not get entry: %v", err)
+	}
+	if err := p.store.remove(blobName(e.Blob)); err != nil {
+		t.Fatalf("can not remove image: %v", err)
+	}
+
+	problems, err := p.fsck()
+	if err != nil {
+		t.Fatalf("fsck returned error: %v", err)
+	}
+	if len(problems) != 1 {
+		t.Fatalf("got problems %v, expected the missing image", problems)
+	}
+
+	if err := problems[0].repair(); err != nil {
+		t.Fatalf("repair returned error: %v", err)
+	}
+
+	if _, err := p.getEntry(result.id); err != errUnknownImage {
+		t.Errorf("entry still exists: %v", err)
+	}
+	if _, err := p.store.stat("error/" + strconv.Itoa(result.id)); err != nil {
+		t.Errorf("mail was not moved to the error folder: %v", err)
+	}
+}
+
+func TestFsckAcceptsEmptyExtension(t *testing.T) {
+	p := setupTest(t, "[duplicates]\naction = \"accept\"\n")
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board, noReply: true})
+	if err != nil {
+		t.Fatalf("insert returned error: %v", err)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", p.key("entry", strconv.Itoa(result.id)), "fileext", ""); err != nil {
+		t.Fatalf("can not change extension: %v", err)
+	}
+
+	problems, err := p.fsck()
+	if err != nil {
+		t.Fatalf("fsck returned error: %v", err)
+	}
+	for _, problem := range problems {
+		t.Errorf("unexpected problem: %s", problem.description)
+	}
+}
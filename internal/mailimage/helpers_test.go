@@ -0,0 +1,97 @@
+package mailimage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// testRedisURL returns the redis that is used by the tests. It can be set with
+// the environment variable MAILIMAGE_TEST_REDIS.
+func testRedisURL() string {
+	if u := os.Getenv("MAILIMAGE_TEST_REDIS"); u != "" {
+		return u
+	}
+	return "redis://localhost:6379"
+}
+
+// setupTest loads a config with an empty MAILIMAGE_PATH and a new redis prefix
+// and returns the pool of the only board. extra is put at the beginning of the
+// config file. The test is skipped, if redis is not available.
+//
+// All keys of the prefix are deleted and the globals are reset after the test.
+func setupTest(t testing.TB, extra string) *pool {
+	t.Helper()
+
+	dir := t.TempDir()
+	oldPath, hadPath := os.LookupEnv("MAILIMAGE_PATH")
+	os.Setenv("MAILIMAGE_PATH", dir)
+
+	prefix := "mailimage-test-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	config := fmt.Sprintf("%s\n[redis]\nurl = %q\nprefix = %q\n\n[mailer]\ntype = \"none\"\n", extra, testRedisURL(), prefix)
+	configPath := filepath.Join(dir, "mailimage.toml")
+	if err := ioutil.WriteFile(configPath, []byte(config), 0644); err != nil {
+		t.Fatalf("can not write config: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if hadPath {
+			os.Setenv("MAILIMAGE_PATH", oldPath)
+		} else {
+			os.Unsetenv("MAILIMAGE_PATH")
+		}
+		cfg, outbound, boards, selected = defaultConfig(), nil, nil, nil
+	})
+
+	if err := LoadConfig(configPath); err != nil {
+		t.Fatalf("can not load config: %v", err)
+	}
+
+	p, err := newPool(cfg.Redis)
+	if err != nil {
+		t.Skipf("redis is not available: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn := p.Get()
+		defer conn.Close()
+
+		keys, err := redis.Strings(conn.Do("KEYS", prefix+":*"))
+		if err != nil {
+			t.Errorf("can not receive test keys: %v", err)
+			return
+		}
+
+		for _, k := range keys {
+			conn.Send("DEL", k)
+		}
+		if err := conn.Flush(); err != nil {
+			t.Errorf("can not delete test keys: %v", err)
+		}
+		for range keys {
+			conn.Receive()
+		}
+		p.Close()
+	})
+	return p
+}
+
+// queuedMails returns the number of mails in the queue of the board.
+func queuedMails(t testing.TB, p *pool) int {
+	t.Helper()
+
+	conn := p.Get()
+	defer conn.Close()
+
+	n, err := redis.Int(conn.Do("ZCARD", p.key("mailq")))
+	if err != nil {
+		t.Fatalf("can not count queued mails: %v", err)
+	}
+	return n
+}
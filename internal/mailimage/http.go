@@ -1,82 +1,230 @@
 package mailimage
 
 import (
-	"html/template"
+	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 	"path/filepath"
-	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"golang.org/x/xerrors"
 )
 
-//go:generate go run ../../scripts/buildHTML.go
-var indexTmpl = template.Must(template.New("indexPage").Parse(indexHTMLTemplate))
-
-// Serve creates the handlers and listen and serves it
+// Serve creates the handlers of all boards and listen and serves them. If a
+// board was selected, only this board is served.
 func Serve(addr string) error {
-	pool, err := newPool(redisAddr)
+	rp, err := dialRedis(cfg.Redis)
 	if err != nil {
 		return err
 	}
 
-	h := handler{redis: pool}
+	served := boards
+	if selected != nil {
+		served = []*board{selected}
+	}
+
+	var router boardRouter
+	for _, b := range served {
+		pool, err := newBoardPool(rp, b)
+		if err != nil {
+			return err
+		}
+
+		if err := pool.checkSchema(); err != nil {
+			return xerrors.Errorf("board %s: %w", b, err)
+		}
+
+		// Finish the inserts that where interrupted
+		if err := pool.recoverProgress(logWriter{}); err != nil {
+			return xerrors.Errorf("can not recover interrupted inserts of board %s: %w", b, err)
+		}
+
+		if cfg.Cache.Enabled {
+			pool.cache = &entryCache{}
+		}
+
+		go b.watchTemplates()
+		go watchQueue(pool)
+		go watchTrash(pool)
+		if cfg.Retention.enabled() {
+			go watchRetention(pool)
+		}
 
-	http.Handle("/", errHandleFunc(h.index))
-	http.Handle("/image/", errHandleFunc(h.image))
-	http.Handle("/thumbnail/", errHandleFunc(h.thumbnail))
-	http.Handle("/delete/", errHandleFunc(h.delete))
+		router = append(router, boardRoute{board: b, handler: newBoardHandler(pool)})
+	}
 
-	return http.ListenAndServe(addr, nil)
+	return http.ListenAndServe(addr, router)
+}
+
+// newBoardHandler returns the handler for the website, the admin pages and
+// the admin api of a board.
+func newBoardHandler(pool *pool) http.Handler {
+	h := handler{redis: pool}
+	b := pool.board
+
+	mux := http.NewServeMux()
+	mux.Handle("/", errHandler{b, h.index})
+	mux.Handle("/post/", errHandler{b, h.post})
+	mux.Handle("/image/", errHandler{b, h.image})
+	mux.Handle("/thumbnail/", errHandler{b, h.thumbnail})
+	mux.Handle("/delete/", errHandler{b, h.delete})
+	mux.Handle("/undo/", errHandler{b, h.undo})
+	mux.Handle("/admin/trash", adminPage{b, h.trash})
+	mux.Handle("/admin/trash/", adminPage{b, h.restore})
+	mux.Handle("/api/entry/", adminHandler(h.apiEntry))
+	mux.Handle("/api/trash", adminHandler(h.apiTrash))
+	mux.Handle("/api/restore/", adminHandler(h.apiRestore))
+	return mux
 }
 
 type handler struct {
 	redis *pool
 }
 
-// index returns the index page that list all images
+// pageData is the data for the html templates.
+type pageData struct {
+	Lang string
+
+	// Board is the title of the board in the page titles.
+	Board string
+
+	// Entries, PrevPage and NextPage are used by the index page, Entry by the
+	// post page and Status and Message by the error page. The deleted page
+	// uses Message, UndoLink and BackLink and the trash page uses Trash.
+	Entries  []entry
+	PrevPage int
+	NextPage int
+	Entry    entry
+	Status   int
+	Message  string
+	UndoLink string
+	BackLink string
+	Trash    []trashedEntry
+}
+
+// newPageData creates the page data of the board with the language of the
+// request.
+func (b *board) newPageData(w http.ResponseWriter, r *http.Request) pageData {
+	lang := matchLanguage(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+
+	// The website of the default board keeps its old title
+	title := "Mailimage"
+	if b.name != "" {
+		title = b.title
+	}
+	return pageData{Lang: lang, Board: title}
+}
+
+// T returns the text for a key of the message catalog in the language of the
+// page.
+func (d pageData) T(key string) string {
+	return translate(d.Lang, msgKey(key))
+}
+
+// Date formats a time with the date format of the language of the page.
+func (d pageData) Date(t time.Time) string {
+	return formatDate(d.Lang, t)
+}
+
+// index returns the index page that list the images, the newest first. The
+// page is selected with the query parameter "page".
 func (h *handler) index(w http.ResponseWriter, r *http.Request) error {
-	entries, err := h.redis.listEntries()
+	page := 1
+	if v := r.URL.Query().Get("page"); v != "" {
+		var err error
+		page, err = strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return errUnknownImage
+		}
+	}
+
+	entries, total, err := h.redis.entryPage((page-1)*cfg.PageSize, cfg.PageSize)
 	if err != nil {
 		return err
 	}
 
-	sort.Sort(sort.Reverse(byCreated(entries)))
-	if err := indexTmpl.Execute(w, entries); err != nil {
+	if page > 1 && len(entries) == 0 {
+		return errUnknownImage
+	}
+
+	data := h.redis.newPageData(w, r)
+	data.Entries = entries
+	if page > 1 {
+		data.PrevPage = page - 1
+	}
+	if cfg.PageSize > 0 && page*cfg.PageSize < total {
+		data.NextPage = page + 1
+	}
+	if err := h.redis.getTemplates().index.Execute(w, data); err != nil {
 		return xerrors.Errorf("can not execute index html template: %w", err)
 	}
 	return nil
 }
 
-// image returns an image via http.
-func (h *handler) image(w http.ResponseWriter, r *http.Request) error {
-	filename := r.URL.Path[len("/image/"):]
-	requestedExt := filepath.Ext(filename)
+// post returns a page that shows one image.
+func (h *handler) post(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.URL.Path[len("/post/"):])
+	if err != nil {
+		return errUnknownImage
+	}
 
-	id, err := strconv.Atoi(filename[0 : len(filename)-len(requestedExt)])
+	e, err := h.redis.getEntry(id)
 	if err != nil {
+		return err
+	}
+
+	data := h.redis.newPageData(w, r)
+	data.Entry = e
+	if err := h.redis.getTemplates().post.Execute(w, data); err != nil {
+		return xerrors.Errorf("can not execute post html template: %w", err)
+	}
+	return nil
+}
+
+// image returns an image via http.
+//
+// The path is /image/<id>/<hash><ext> or /image/<id><ext>. Responses for paths
+// with the hash can be cached forever.
+func (h *handler) image(w http.ResponseWriter, r *http.Request) error {
+	id, hash, ext, ok := parseImagePath(r.URL.Path[len("/image/"):])
+	if !ok {
 		w.WriteHeader(404)
 		return nil
 	}
 
-	dbExt, err := h.redis.getExtension(id)
+	e, err := h.redis.getEntry(id)
 	if err != nil {
 		return err
 	}
 
-	if requestedExt != dbExt {
+	if ext != e.Extension || (hash != "" && hash != e.Blob) {
 		w.WriteHeader(404)
 		return nil
 	}
 
-	image, err := openImage(id, dbExt)
+	if e.Blob != "" {
+		if ok, err := h.redis.redirectToStore(w, r, blobName(e.Blob), mime.TypeByExtension(e.Extension)); ok || err != nil {
+			return err
+		}
+	}
+
+	image, err := h.redis.openImage(e.Blob)
 	if err != nil {
 		return err
 	}
 	defer image.Close()
 
+	if hash != "" {
+		setImmutable(w)
+	}
+
 	if _, err := io.Copy(w, image); err != nil {
 		return xerrors.Errorf("can not write image to response writer: %w", err)
 	}
@@ -84,29 +232,103 @@ func (h *handler) image(w http.ResponseWriter, r *http.Request) error {
 }
 
 // thumbnail returns a thunbmail from an image via http.
+//
+// The path is /thumbnail/<id>/<hash>.jpg or /thumbnail/<id>.jpg.
 func (h *handler) thumbnail(w http.ResponseWriter, r *http.Request) error {
-	filename := r.URL.Path[len("/thumbnail/"):]
+	id, hash, ext, ok := parseImagePath(r.URL.Path[len("/thumbnail/"):])
+	if !ok || ext != ".jpg" {
+		w.WriteHeader(404)
+		return nil
+	}
 
-	// valid thumbnails end with .jpg. Strip it to get the file number
-	id, err := strconv.Atoi(filename[0 : len(filename)-4])
+	e, err := h.redis.getEntry(id)
 	if err != nil {
+		return err
+	}
+
+	if hash != "" && hash != e.Blob {
 		w.WriteHeader(404)
 		return nil
 	}
 
-	thumbnail, err := openThumbnail(id, h.redis)
+	if cfg.Storage.Redirect && e.Blob != "" {
+		// The thumbnail has to exist, before the client is redirected to it
+		if _, err := h.redis.store.stat(thumbnailName(e.Blob)); os.IsNotExist(err) {
+			if err := h.redis.createThumbnail(e.Blob); err != nil {
+				return err
+			}
+		}
+
+		if ok, err := h.redis.redirectToStore(w, r, thumbnailName(e.Blob), "image/jpeg"); ok || err != nil {
+			return err
+		}
+	}
+
+	thumbnail, err := h.redis.openThumbnail(e.Blob)
 	if err != nil {
 		return err
 	}
 	defer thumbnail.Close()
 
+	if hash != "" {
+		setImmutable(w)
+	}
+
 	if _, err := io.Copy(w, thumbnail); err != nil {
 		return xerrors.Errorf("can not write thumbnail to response writer: %w", err)
 	}
 	return nil
 }
 
-// delete deletes an image for an given token.
+// parseImagePath splits a path of the form <id>/<hash><ext> or <id><ext>. hash
+// is empty for the second form.
+func parseImagePath(p string) (id int, hash, ext string, ok bool) {
+	ext = filepath.Ext(p)
+	name := p[:len(p)-len(ext)]
+	if i := strings.Index(name, "/"); i >= 0 {
+		name, hash = name[:i], name[i+1:]
+		if !validBlobHash(hash) {
+			return 0, "", "", false
+		}
+	}
+
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, "", "", false
+	}
+	return id, hash, ext, true
+}
+
+// setImmutable tells the clients, that the response never changes.
+func setImmutable(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+}
+
+// redirectToStore redirects the client to a presigned url of a file in the
+// store, if it is enabled in the config and the store supports it. Returns
+// true, if the client was redirected.
+func (b *board) redirectToStore(w http.ResponseWriter, r *http.Request, name, contentType string) (bool, error) {
+	if !cfg.Storage.Redirect {
+		return false, nil
+	}
+
+	link, err := b.store.url(name, contentType)
+	if err != nil {
+		return false, xerrors.Errorf("can not create link to %s: %w", name, err)
+	}
+
+	if link == "" {
+		return false, nil
+	}
+
+	// The link expires, so the redirect can not be cached for long
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(cfg.Storage.URLExpiry/time.Second/2)))
+	http.Redirect(w, r, link, http.StatusFound)
+	return true, nil
+}
+
+// delete moves an image for an given token into the trash and shows a page
+// with a link to undo it.
 func (h *handler) delete(w http.ResponseWriter, r *http.Request) error {
 	token := r.URL.Path[len("/delete/"):]
 
@@ -114,20 +336,68 @@ func (h *handler) delete(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	http.Redirect(w, r, deleteRedirectURL, http.StatusFound)
+	if cfg.Trash.Keep == 0 {
+		http.Redirect(w, r, h.redis.deleteRedirectURL, http.StatusFound)
+		return nil
+	}
+
+	data := h.redis.newPageData(w, r)
+	data.Message = translate(data.Lang, msgUndoUntil, time.Now().Add(cfg.Trash.Keep))
+	data.UndoLink = fmt.Sprintf("%s/undo/%s", h.redis.baseURL, token)
+	data.BackLink = h.redis.deleteRedirectURL
+	if err := h.redis.getTemplates().deleted.Execute(w, data); err != nil {
+		return xerrors.Errorf("can not execute deleted html template: %w", err)
+	}
 	return nil
 }
 
-type errHandleFunc func(w http.ResponseWriter, r *http.Request) error
+// undo restores an image from the trash, that was deleted with a token. The
+// form on the deleted page sends it as POST request.
+func (h *handler) undo(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return errMethodNotAllowed
+	}
 
-func (f errHandleFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if err := f(w, r); err != nil {
-		if err == errUnknownImage {
-			w.WriteHeader(404)
-			return
+	token := r.URL.Path[len("/undo/"):]
+
+	id, err := h.redis.restoreFromToken(token)
+	if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, h.redis.postURL(id), http.StatusFound)
+	return nil
+}
+
+// errHandler calls a handler of a board. If the handler returns an error, the
+// error page of the board is shown.
+type errHandler struct {
+	board *board
+	f     func(w http.ResponseWriter, r *http.Request) error
+}
+
+func (e errHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := e.f(w, r); err != nil {
+		data := e.board.newPageData(w, r)
+		data.Status = http.StatusInternalServerError
+		data.Message = translate(data.Lang, msgServerError)
+
+		switch err {
+		case errUnknownImage:
+			data.Status = http.StatusNotFound
+			data.Message = translate(data.Lang, msgNotFound)
+		case errMethodNotAllowed:
+			data.Status = http.StatusMethodNotAllowed
+			data.Message = translate(data.Lang, msgNotAllowed)
+		default:
+			log.Printf("Error on board %s: %v", e.board, err)
 		}
 
-		log.Printf("Error: %v", err)
-		http.Error(w, "Ups, something went wrong!", http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(data.Status)
+		if err := e.board.getTemplates().errorPage.Execute(w, data); err != nil {
+			log.Printf("Can not execute error html template: %v", err)
+		}
 	}
 }
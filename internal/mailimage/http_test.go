@@ -0,0 +1,48 @@
+package mailimage
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestUndoNeedsPost(t *testing.T) {
+	p := setupTest(t, trashConfigTOML)
+	id := insertTestEntry(t, p)
+	handler := newBoardHandler(p)
+
+	conn := p.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "deletetoken"))
+	if err != nil {
+		t.Fatalf("can not receive delete token: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/delete/"+token, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete returned status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/undo/"+token, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("undo with GET returned status %d, expected %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+	if _, err := p.getEntry(id); err != errUnknownImage {
+		t.Errorf("entry was restored with GET: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/undo/"+token, nil))
+	if rec.Code != http.StatusFound {
+		t.Errorf("undo with POST returned status %d, expected %d", rec.Code, http.StatusFound)
+	}
+	if _, err := p.getEntry(id); err != nil {
+		t.Errorf("entry was not restored with POST: %v", err)
+	}
+}
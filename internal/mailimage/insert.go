@@ -1,139 +1,357 @@
 package mailimage
 
 import (
-	"fmt"
+	"bufio"
+	"bytes"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/mail"
+	"net/textproto"
 	"os"
-	"path"
 	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
+	"time"
 
+	"github.com/disintegration/imaging"
 	"github.com/jhillyerd/enmime"
 	"golang.org/x/xerrors"
 )
 
 // Insert saves an image to the database and the filesystem
+//
+// The progress of the insert is recorded in a journal. If an error happens,
+// all changes are rolled back and the mail is moved to the error folder. If the
+// process dies, the insert can be finished with Recover.
 func Insert(in io.Reader) error {
+	_, err := insert(in, insertOptions{board: selected})
+	return err
+}
+
+// insertOptions changes the behavior of insert.
+type insertOptions struct {
+	// board is the board of the mail. If it is nil, the board is found by
+	// the recipients of the mail.
+	board *board
+
+	// noReply suppresses all responses to the sender.
+	noReply bool
+}
+
+// insertResult describes where an inserted mail ended up.
+type insertResult struct {
+	// folder is the folder of the mail. It is empty, if the mail could not be
+	// saved at all.
+	folder string
+
+	// id is the id of the new entry, if the mail was successfully inserted.
+	id int
+}
+
+// insert is Insert with options.
+func insert(in io.Reader, opts insertOptions) (result insertResult, err error) {
+	b := opts.board
+	if b == nil {
+		var header textproto.MIMEHeader
+		header, in = readHeader(in)
+		if b, err = routeMail(header); err != nil {
+			// Keep the mail, so it is not lost by a wrong config
+			name, e := saveUnrouted(in)
+			if e != nil {
+				return result, xerrors.Errorf("%v and %w", err, e)
+			}
+			log.Printf("Mail without board saved as %s", name)
+			return insertResult{folder: unroutedFolder}, err
+		}
+	}
+
 	// Open file to save mail
-	f, err := newMailFile()
+	f, err := newMailFile(b)
 	if err != nil {
-		return xerrors.Errorf("can not open mail file for writing: %w", err)
+		return result, xerrors.Errorf("can not open mail file for writing: %w", err)
 	}
 	defer f.Close()
 
+	j, err := newJournal(f)
+	if err != nil {
+		if e := os.Remove(f.path()); e != nil {
+			log.Printf("Can not remove mail file: %v", e)
+		}
+		return result, err
+	}
+
 	// Save mail to file as soon as `in` is read
 	in = io.TeeReader(in, f)
 
-	// If an error happens after this line, move mail to error folder
+	// If an error happens after this line, roll back the insert. pool is set,
+	// after the connection to redis is created.
+	var pool *pool
 	defer func() {
-		if err != nil {
-			if e := f.move("error"); e != nil {
-				log.Printf("Can not move mail to error folder: %v", e)
+		if err == nil {
+			if e := j.remove(); e != nil {
+				log.Printf("Can not remove journal: %v", e)
+			}
+
+			if result.folder == "" {
+				result.folder = f.folder
 			}
+			return
+		}
+
+		result = insertResult{folder: "error"}
+		if e := j.rollback(pool); e != nil {
+			j.close()
+			result.folder = "progress"
+			log.Printf("Can not roll back insert of %s: %v", f.name, e)
 		}
 	}()
 
 	// Build enmime envelope by reading `in`
 	envelope, err := enmime.ReadEnvelope(in)
 	if err != nil {
-		return xerrors.Errorf("can not interprete mail: %w", err)
+		return result, xerrors.Errorf("can not interprete mail: %w", err)
 	}
 
 	// Read the senders address
 	from, err := mail.ParseAddress(envelope.Root.Header.Get("from"))
 	if err != nil {
-		return xerrors.Errorf("can not interprete mail address: %w", err)
+		return result, xerrors.Errorf("can not interprete mail address: %w", err)
+	}
+
+	to := newRecipient(envelope.Root.Header, from)
+	to.noReply = opts.noReply
+
+	// Check if the mail was really send from the sender. This happens before
+	// anything is answered, so no mail is send to a spoofed address. Errors
+	// are not answered either.
+	if cfg.Auth.enabled() {
+		// Read the rest of the mail, so the file contains the whole mail
+		if _, err := io.Copy(ioutil.Discard, in); err != nil {
+			return result, xerrors.Errorf("can not read mail: %w", err)
+		}
+
+		raw, err := os.Open(f.path())
+		if err != nil {
+			return result, xerrors.Errorf("can not open mail file: %w", err)
+		}
+		auth, err := authenticate(raw, envelope.Root.Header, from.Address)
+		raw.Close()
+		if err != nil {
+			return result, err
+		}
+
+		// Never respond to mails that can not be authenticated. The from
+		// address could be spoofed.
+		switch cfg.Auth.action(auth) {
+		case "quarantine":
+			log.Printf("Mail from %s with authentication result %s moved to quarantine", from.Address, auth)
+			if err := f.move("quarantine"); err != nil {
+				return result, xerrors.Errorf("can not move mail to quarantine folder: %w", err)
+			}
+			return result, nil
+
+		case "reject":
+			log.Printf("Mail from %s with authentication result %s rejected", from.Address, auth)
+			if err := f.move("rejected"); err != nil {
+				return result, xerrors.Errorf("can not move mail to rejected folder: %w", err)
+			}
+			return result, nil
+		}
+	}
+
+	pool, err = newPoolForBoard(cfg.Redis, b)
+	if err != nil {
+		return result, xerrors.Errorf("can not create redis pool to same mail %s: %w", f.name, err)
+	}
+
+	// Do not write entries in an old layout. The mail stays in the error
+	// folder and can be reprocessed after `mailimage migrate`.
+	if err := pool.checkSchema(); err != nil {
+		return result, xerrors.Errorf("board %s: %w", b, err)
 	}
 
 	// If an error happens after this line, send a respond mail
 	defer func() {
 		if err != nil {
 			// TODO: Don't send the error template but a "500" template
-			if e := respondError(from.Name, from.Address, "Fehler", []error{errInternal}); e != nil {
+			if e := respondError(pool, to, translate(to.lang, msgErrorSubject), []error{errInternal}); e != nil {
 				log.Printf("Can not send an error mail: %v", e)
 			}
 		}
 	}()
 
+	// Check if the sender is allowed to post images
+	rules, err := pool.senderRules()
+	if err != nil {
+		return result, err
+	}
+
+	if !rules.allowed(from.Address) {
+		if err := f.move("rejected"); err != nil {
+			return result, xerrors.Errorf("can not move mail to rejected folder: %w", err)
+		}
+
+		if cfg.Senders.Reject == "drop" {
+			log.Printf("Dropped mail from rejected sender %s", from.Address)
+			return result, nil
+		}
+
+		subject := strings.TrimSpace(envelope.GetHeader("subject"))
+		if err := respondError(pool, to, subject, []error{senderRejectError()}); err != nil {
+			return result, xerrors.Errorf("can not responde to rejected mail: %w", err)
+		}
+		return result, nil
+	}
+
 	// Parse the mail and get the relevant informations
-	subject, text, imageExt, image, errs := parseMail(envelope)
+	subject, text, imageExt, image, lifetime, errs := parseMail(envelope)
 	if len(errs) > 0 {
 		if err := f.move("invalid"); err != nil {
-			return xerrors.Errorf("can not move mail to invalid folder: %w", err)
+			return result, xerrors.Errorf("can not move mail to invalid folder: %w", err)
 		}
 
-		if err := respondError(from.Name, from.Address, subject, errs); err != nil {
-			return xerrors.Errorf("can not responde to invalid mail: %w", err)
+		if err := respondError(pool, to, subject, errs); err != nil {
+			return result, xerrors.Errorf("can not responde to invalid mail: %w", err)
 		}
-		return nil
+		return result, nil
 	}
 
-	pool, err := newPool(redisAddr)
-	if err != nil {
-		return xerrors.Errorf("can not create redis pool to same mail %s: %w", f.name, err)
-	}
+	// Check that the image was not posted before
+	decoded, decodeErr := imaging.Decode(bytes.NewReader(image))
+	if decodeErr != nil {
+		log.Printf("Can not decode image: %v", decodeErr)
+		if err := f.move("invalid"); err != nil {
+			return result, xerrors.Errorf("can not move mail to invalid folder: %w", err)
+		}
 
-	// Save data to redis
-	id, token, err := pool.postEntry(from.Name, from.Address, subject, text, imageExt)
-	if err != nil {
-		return xerrors.Errorf("can not save mail: %w", err)
+		if err := respondError(pool, to, subject, []error{errParsingImage}); err != nil {
+			return result, xerrors.Errorf("can not responde to invalid mail: %w", err)
+		}
+		return result, nil
 	}
+	hash := imageHash(decoded)
 
-	// If an error happens after this line, delete element from redis
-	defer func() {
+	if cfg.Duplicates.Action != "accept" {
+		duplicateID, err := pool.findDuplicate(hash)
 		if err != nil {
-			if e := pool.deleteFromID(id); e != nil {
-				log.Printf("Cat not remove element %d from redis: %v", id, err)
+			return result, err
+		}
+
+		if duplicateID != 0 {
+			if cfg.Duplicates.Action == "quarantine" {
+				log.Printf("Mail from %s is a duplicate of %d, moved to quarantine", from.Address, duplicateID)
+				if err := f.move("quarantine"); err != nil {
+					return result, xerrors.Errorf("can not move mail to quarantine folder: %w", err)
+				}
+				return result, nil
 			}
+
+			if err := f.move("rejected"); err != nil {
+				return result, xerrors.Errorf("can not move mail to rejected folder: %w", err)
+			}
+
+			if err := respondError(pool, to, subject, []error{newUserError(msgDuplicate, pool.postURL(duplicateID))}); err != nil {
+				return result, xerrors.Errorf("can not responde to duplicate mail: %w", err)
+			}
+			return result, nil
+		}
+	}
+
+	// Check that the sender did not post too many images
+	until, counters, err := pool.useQuota(from.Address, time.Now())
+	if err != nil {
+		return result, err
+	}
+
+	j.Quota = counters
+	if err := j.set(stateReceived); err != nil {
+		return result, err
+	}
+
+	if !until.IsZero() {
+		if err := f.move("rejected"); err != nil {
+			return result, xerrors.Errorf("can not move mail to rejected folder: %w", err)
 		}
-	}()
 
-	// Save image to disk
-	if err := os.MkdirAll(path.Join(mailimagePath(), "images"), os.ModePerm); err != nil {
-		return xerrors.Errorf("can not create folder images: %w", err)
+		if err := respondError(pool, to, subject, []error{newUserError(msgQuota, until)}); err != nil {
+			return result, xerrors.Errorf("can not responde to mail over quota: %w", err)
+		}
+		return result, nil
 	}
 
-	imagePath := path.Join(mailimagePath(), "images", fmt.Sprintf("%d%s", id, imageExt))
-	err = ioutil.WriteFile(imagePath, image, 0644)
+	// Save data to redis
+	id, err := pool.getNewID()
 	if err != nil {
-		return xerrors.Errorf("can not save image to disk: %w", err)
+		return result, err
 	}
 
-	// If an error happens after this line, delete image from disk
-	defer func() {
-		if err != nil {
-			if e := os.Remove(imagePath); e != nil {
-				log.Printf("Can not remove image: %v", e)
-			}
+	j.ID, j.Ext, j.Blob = id, imageExt, blobHash(image)
+	if err := j.set(statePosted); err != nil {
+		return result, err
+	}
+
+	token, err := pool.postEntry(id, from.Name, from.Address, subject, text, imageExt)
+	if err != nil {
+		return result, xerrors.Errorf("can not save mail: %w", err)
+	}
+
+	if err := pool.setImageHash(id, hash); err != nil {
+		return result, err
+	}
+
+	if lifetime > 0 {
+		if err := pool.setExpiry(id, time.Now().Add(lifetime)); err != nil {
+			return result, err
 		}
-	}()
+	}
 
-	// Move mail to success and rename it to its id
-	if err := f.rename(strconv.Itoa(id)); err != nil {
-		return err
+	// Save image to disk. The blob is linked first, so a rollback deletes it.
+	if err := pool.linkBlob(id, j.Blob); err != nil {
+		return result, err
+	}
+
+	if _, err := pool.storeBlob(image); err != nil {
+		return result, err
 	}
 
-	if err := f.move("success"); err != nil {
-		return err
+	if err := j.set(stateStored); err != nil {
+		return result, err
 	}
 
-	if err := respondSuccess(from.Name, from.Address, subject, token); err != nil {
-		return xerrors.Errorf("can not send success mail: %w", err)
+	// Move mail to success and rename it to its id
+	if err := j.complete(); err != nil {
+		return result, err
+	}
+
+	// The image is posted, even if the response can not be send
+	if err := respondSuccess(pool, to, subject, j.Blob, token); err != nil {
+		log.Printf("Can not send success mail for image %d: %v", id, err)
 	}
-	return nil
+	return insertResult{folder: "success", id: id}, nil
+}
+
+// readHeader reads the header of a mail. Returns the header and a reader for
+// the whole mail. If the header is invalid, it is returned as far as it could
+// be read.
+func readHeader(in io.Reader) (textproto.MIMEHeader, io.Reader) {
+	var buf bytes.Buffer
+	header, _ := textproto.NewReader(bufio.NewReader(io.TeeReader(in, &buf))).ReadMIMEHeader()
+	return header, io.MultiReader(&buf, in)
 }
 
 // parseMail parses an email and returns all relevant information about it
-func parseMail(mail *enmime.Envelope) (subject, text, imageExt string, image []byte, errs []error) {
+//
+// lifetime is the lifetime that was set by the sender in the subject. It is 0,
+// if the sender did not set a lifetime or if it is not allowed.
+func parseMail(mail *enmime.Envelope) (subject, text, imageExt string, image []byte, lifetime time.Duration, errs []error) {
 	errs = make([]error, 0)
 
 	subject = strings.TrimSpace(mail.GetHeader("subject"))
 	subject = strings.TrimPrefix(subject, "***SPAM***")
+	if cfg.Retention.SenderExpiry {
+		subject, lifetime = splitLifetime(subject)
+	}
 	if len(subject) > subjectLength {
 		errs = append(errs, errLongSubject)
 	}
@@ -149,7 +367,7 @@ func parseMail(mail *enmime.Envelope) (subject, text, imageExt string, image []b
 		errs = append(errs, err)
 	}
 
-	return subject, text, imageExt, image, errs
+	return subject, text, imageExt, image, lifetime, errs
 }
 
 // parseAttachments parses all attachments from an mail body and looks for supported images
@@ -0,0 +1,63 @@
+package mailimage
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// authConfigTOML verifies dkim signatures and rejects mails that fail.
+const authConfigTOML = `
+[auth]
+verify_dkim = true
+fail = "reject"
+none = "quarantine"
+`
+
+func TestInsertAuthentication(t *testing.T) {
+	signed := testMail(t, "user@example.org", "example.org")
+	tampered := bytes.Replace(signed, []byte("Frischer Kohl"), []byte("Fauler Kohl"), 1)
+	name, record := dkimRecord(t, "example.org")
+
+	for _, tt := range []struct {
+		name    string
+		senders string
+		raw     []byte
+		dnsErr  error
+		folder  string
+		replies int
+		err     bool
+	}{
+		{name: "pass", raw: signed, folder: "success", replies: 1},
+		{name: "fail", raw: tampered, folder: "rejected"},
+		{name: "fail blocked sender", senders: "[senders]\nblock = [\"user@example.org\"]\n", raw: tampered, folder: "rejected"},
+		{name: "pass blocked sender", senders: "[senders]\nblock = [\"user@example.org\"]\n", raw: signed, folder: "rejected", replies: 1},
+		{name: "temperror", raw: signed, dnsErr: &net.DNSError{Err: "timeout", Name: name, IsTimeout: true, IsTemporary: true}, folder: "error", err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := setupTest(t, authConfigTOML+tt.senders)
+
+			records := map[string]string{}
+			if tt.dnsErr == nil {
+				records[name] = record
+			}
+			stubDNS(t, records, tt.dnsErr)
+
+			result, err := insert(bytes.NewReader(tt.raw), insertOptions{board: p.board})
+			if tt.err && err == nil {
+				t.Errorf("insert returned no error")
+			}
+			if !tt.err && err != nil {
+				t.Errorf("insert returned error: %v", err)
+			}
+
+			if result.folder != tt.folder {
+				t.Errorf("mail is in folder %q, expected %q", result.folder, tt.folder)
+			}
+
+			if got := queuedMails(t, p); got != tt.replies {
+				t.Errorf("%d replies queued, expected %d", got, tt.replies)
+			}
+		})
+	}
+}
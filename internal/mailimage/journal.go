@@ -0,0 +1,368 @@
+package mailimage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// insertState is the state of an insert. The states are passed in this order.
+// An insert can be finished in every state by moving the mail out of the
+// progress folder.
+type insertState string
+
+const (
+	// stateReceived means, that the mail is saved in the progress folder.
+	// Nothing else was changed.
+	stateReceived insertState = "received"
+
+	// statePosted means, that the entry with the id from the journal may
+	// exist in redis and the image may exist on disk.
+	statePosted insertState = "posted"
+
+	// stateStored means, that the entry exists in redis and the image exists
+	// on disk. Only the mail has to be moved to the success folder.
+	stateStored insertState = "stored"
+
+	// stateDone means, that the insert is finished.
+	stateDone insertState = "done"
+)
+
+// journalSuffix is appended to the name of a mail in the progress folder to
+// get the name of its journal.
+const journalSuffix = ".journal"
+
+// staleMailAge is the age after which a mail in the progress folder without a
+// journal is seen as abandoned.
+const staleMailAge = 10 * time.Minute
+
+// journal records the state of an insert, so it can be completed or rolled
+// back, if the process dies. It is a file next to the mail in the progress
+// folder. Each state change appends one line. The journal is locked as long as
+// the insert is running.
+type journal struct {
+	file  *os.File
+	board *board
+
+	// mail is the name of the mail in the progress folder.
+	mail string
+
+	State insertState `json:"state"`
+	ID    int         `json:"id,omitempty"`
+	Ext   string      `json:"ext,omitempty"`
+	Blob  string      `json:"blob,omitempty"`
+
+	// Quota are the counters of the post limits that were increased for
+	// the mail. They are decreased on a rollback.
+	Quota []string `json:"quota,omitempty"`
+}
+
+// newJournal creates and locks the journal for a mail in the progress folder.
+func newJournal(f *mailFile) (*journal, error) {
+	file, err := os.OpenFile(f.path()+journalSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, xerrors.Errorf("can not create journal: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		return nil, xerrors.Errorf("can not lock journal: %w", err)
+	}
+
+	j := &journal{file: file, board: f.board, mail: f.name}
+	if err := j.set(stateReceived); err != nil {
+		j.close()
+		return nil, err
+	}
+	return j, nil
+}
+
+// openJournal opens and locks an existing journal of a board and reads its
+// last state. Returns errJournalLocked, if the insert is still running.
+func openJournal(b *board, name string) (*journal, error) {
+	file, err := os.OpenFile(path.Join(b.path, "progress", name+journalSuffix), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, xerrors.Errorf("can not open journal: %w", err)
+	}
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errJournalLocked
+		}
+		return nil, xerrors.Errorf("can not lock journal: %w", err)
+	}
+
+	j := &journal{file: file, board: b, mail: name, State: stateReceived}
+
+	// Use the last complete line. A line can be incomplete, if the process
+	// died while writing it.
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line journal
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		j.State, j.ID, j.Ext, j.Blob, j.Quota = line.State, line.ID, line.Ext, line.Blob, line.Quota
+	}
+	if err := scanner.Err(); err != nil {
+		j.close()
+		return nil, xerrors.Errorf("can not read journal: %w", err)
+	}
+	return j, nil
+}
+
+// errJournalLocked is returned by openJournal, if another process is running
+// the insert.
+var errJournalLocked = xerrors.New("journal is locked")
+
+// set changes the state and writes it to disk.
+func (j *journal) set(state insertState) error {
+	j.State = state
+	line, err := json.Marshal(j)
+	if err != nil {
+		return xerrors.Errorf("can not encode journal: %w", err)
+	}
+
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return xerrors.Errorf("can not write journal: %w", err)
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return xerrors.Errorf("can not sync journal: %w", err)
+	}
+	return nil
+}
+
+// close releases the lock of the journal.
+func (j *journal) close() {
+	j.file.Close()
+}
+
+// remove deletes the journal. It has to be called, after the mail was moved
+// out of the progress folder.
+func (j *journal) remove() error {
+	defer j.close()
+	if err := os.Remove(j.file.Name()); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("can not remove journal: %w", err)
+	}
+	return nil
+}
+
+// imageName returns the name of the image of the insert in the store.
+// Journals that where written before the blob store have no blob.
+func (j *journal) imageName() string {
+	if j.Blob == "" {
+		return legacyImageNames(j.ID, j.Ext)[0]
+	}
+	return blobName(j.Blob)
+}
+
+// rollback undoes all changes of an insert and moves the mail to the error
+// folder. It can be called more then once. p can be nil in the state received,
+// if no quota was used.
+func (j *journal) rollback(p *pool) error {
+	if j.State == statePosted || j.State == stateStored {
+		// The blob is only deleted, if no other entry uses it
+		if err := p.unlinkBlob(j.ID); err != nil {
+			return err
+		}
+
+		if j.Blob == "" {
+			for _, name := range legacyImageNames(j.ID, j.Ext) {
+				if err := j.board.store.remove(name); err != nil {
+					return xerrors.Errorf("can not remove image: %w", err)
+				}
+			}
+		}
+
+		if err := p.removeEntry(j.ID); err != nil {
+			return err
+		}
+	}
+
+	// The mail was not posted, so it does not count. The counters are removed
+	// from the journal, so a second rollback does not refund them again.
+	if len(j.Quota) > 0 {
+		if err := p.refundQuota(j.Quota); err != nil {
+			return err
+		}
+
+		j.Quota = nil
+		if err := j.set(j.State); err != nil {
+			return err
+		}
+	}
+
+	if err := j.moveMail("error"); err != nil {
+		return err
+	}
+
+	return j.remove()
+}
+
+// complete finishes an insert in the state stored by moving the mail to the
+// success folder.
+func (j *journal) complete() error {
+	if err := j.moveMail("success"); err != nil {
+		return err
+	}
+
+	if err := j.set(stateDone); err != nil {
+		return err
+	}
+	return j.remove()
+}
+
+// moveMail moves the mail from the progress folder to a folder. If the insert
+// is in the state stored, the mail is renamed to its id. If the mail is not in
+// the progress folder, nothing is done.
+func (j *journal) moveMail(folder string) error {
+	for _, name := range []string{j.mail, strconv.Itoa(j.ID)} {
+		f := mailFile{board: j.board, name: name, folder: "progress"}
+		if _, err := os.Stat(f.path()); err != nil {
+			continue
+		}
+
+		if j.State == stateStored && name != strconv.Itoa(j.ID) {
+			if err := f.rename(strconv.Itoa(j.ID)); err != nil {
+				return err
+			}
+		}
+		return f.move(folder)
+	}
+	return nil
+}
+
+// recoverInsert completes or rolls back an insert from its journal. Returns a
+// description of what was done.
+func (p *pool) recoverInsert(j *journal) (string, error) {
+	switch j.State {
+	case stateStored:
+		if _, err := p.getEntry(j.ID); err != nil {
+			if err := j.rollback(p); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("rolled back, entry %d does not exist", j.ID), nil
+		}
+
+		if _, err := p.store.stat(j.imageName()); err != nil {
+			if err := j.rollback(p); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("rolled back, image of entry %d does not exist", j.ID), nil
+		}
+
+		if err := j.complete(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("completed as entry %d, no success mail was send", j.ID), nil
+
+	case stateDone:
+		if err := j.remove(); err != nil {
+			return "", err
+		}
+		return "already done", nil
+
+	default:
+		if err := j.rollback(p); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("rolled back from state %s", j.State), nil
+	}
+}
+
+// recoverProgress completes or rolls back all inserts that where interrupted.
+// A line for each mail is written to w. Inserts that are still running are
+// skipped.
+func (p *pool) recoverProgress(w io.Writer) error {
+	progress := path.Join(p.path, "progress")
+	infos, err := ioutil.ReadDir(progress)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return xerrors.Errorf("can not read progress folder: %w", err)
+	}
+
+	for _, info := range infos {
+		if !strings.HasSuffix(info.Name(), journalSuffix) {
+			continue
+		}
+
+		name := strings.TrimSuffix(info.Name(), journalSuffix)
+		j, err := openJournal(p.board, name)
+		if err == errJournalLocked {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		result, err := p.recoverInsert(j)
+		if err != nil {
+			j.close()
+			return xerrors.Errorf("can not recover %s: %w", name, err)
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, result)
+	}
+
+	// Read the folder again, because the recovered mails were moved.
+	infos, err = ioutil.ReadDir(progress)
+	if err != nil {
+		return xerrors.Errorf("can not read progress folder: %w", err)
+	}
+
+	journals := make(map[string]bool)
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), journalSuffix) {
+			journals[strings.TrimSuffix(info.Name(), journalSuffix)] = true
+		}
+	}
+
+	// A mail without journal was never inserted. It is moved to the error
+	// folder, if it was not changed for some time.
+	for _, info := range infos {
+		name := info.Name()
+		if strings.HasSuffix(name, journalSuffix) || journals[name] || time.Since(info.ModTime()) < staleMailAge {
+			continue
+		}
+
+		f := mailFile{board: p.board, name: name, folder: "progress"}
+		if err := f.move("error"); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s: moved to error, no journal\n", name)
+	}
+	return nil
+}
+
+// Recover completes or rolls back all inserts that where interrupted and
+// writes a report to w.
+func Recover(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	return pool.recoverProgress(w)
+}
+
+// logWriter writes each line to the log.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Print(string(p))
+	return len(p), nil
+}
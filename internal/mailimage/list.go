@@ -0,0 +1,214 @@
+package mailimage
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// ListOptions filters the entries for List.
+type ListOptions struct {
+	// From matches the name or the address of the sender.
+	From string
+
+	// Since and Until limit the creation time of the entries. Zero values
+	// are ignored.
+	Since time.Time
+	Until time.Time
+
+	// Search matches the subject or the text.
+	Search string
+
+	// Format is "table", "json" or "csv".
+	Format string
+}
+
+// match returns true, if the entry matches all filters.
+func (o ListOptions) match(e entry) bool {
+	if o.From != "" && !containsFold(e.From, o.From) && !containsFold(e.Mail, o.From) {
+		return false
+	}
+
+	if !o.Since.IsZero() && e.Date.Before(o.Since) {
+		return false
+	}
+
+	if !o.Until.IsZero() && !e.Date.Before(o.Until) {
+		return false
+	}
+
+	if o.Search != "" && !containsFold(e.Subject, o.Search) && !containsFold(e.Text, o.Search) {
+		return false
+	}
+	return true
+}
+
+// containsFold returns true, if substr is in s ignoring the case.
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// listedEntry is an entry how it is written by List.
+type listedEntry struct {
+	ID      int       `json:"id"`
+	Created time.Time `json:"created"`
+	From    string    `json:"from"`
+	Mail    string    `json:"mail"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	Image   string    `json:"image"`
+}
+
+// List writes all entries that match the filters to w.
+func List(w io.Writer, opts ListOptions) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	entries, err := pool.listEntries()
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	var listed []listedEntry
+	for _, e := range entries {
+		if !opts.match(e) {
+			continue
+		}
+
+		listed = append(listed, listedEntry{
+			ID:      e.ID,
+			Created: e.Date,
+			From:    e.From,
+			Mail:    e.Mail,
+			Subject: e.Subject,
+			Text:    e.Text,
+			Image:   fmt.Sprintf("%d%s", e.ID, e.Extension),
+		})
+	}
+
+	switch opts.Format {
+	case "json":
+		if listed == nil {
+			listed = []listedEntry{}
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(listed); err != nil {
+			return xerrors.Errorf("can not encode entries: %w", err)
+		}
+
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "created", "from", "mail", "subject", "text", "image"})
+		for _, e := range listed {
+			cw.Write([]string{strconv.Itoa(e.ID), e.Created.Format(time.RFC3339), e.From, e.Mail, e.Subject, e.Text, e.Image})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return xerrors.Errorf("can not write csv: %w", err)
+		}
+
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tCREATED\tFROM\tSUBJECT")
+		for _, e := range listed {
+			fmt.Fprintf(tw, "%d\t%s\t%s <%s>\t%s\n", e.ID, e.Created.Format("2006-01-02 15:04"), e.From, e.Mail, e.Subject)
+		}
+		tw.Flush()
+
+	default:
+		return xerrors.Errorf("unknown format %s", opts.Format)
+	}
+	return nil
+}
+
+// Show writes all stored data of an entry to w.
+func Show(w io.Writer, id int) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", pool.key("entry", strconv.Itoa(id))))
+	if err != nil {
+		return xerrors.Errorf("can not receive entry %d: %w", id, err)
+	}
+
+	if len(fields) == 0 {
+		return errUnknownImage
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "id\t%d\n", id)
+	for _, name := range names {
+		fmt.Fprintf(tw, "%s\t%s\n", name, fields[name])
+	}
+
+	type file struct {
+		name string
+		path string
+	}
+
+	var files []file
+	if blob := fields["blob"]; blob != "" {
+		files = append(files, file{"image file", blobName(blob)}, file{"thumbnail file", thumbnailName(blob)})
+	} else {
+		fmt.Fprintf(tw, "image file\tnot in the blob store\n")
+	}
+	files = append(files, file{"mail file", path.Join("success", strconv.Itoa(id))})
+
+	for _, file := range files {
+		status := "missing"
+		if info, err := pool.store.stat(file.path); err == nil {
+			status = fmt.Sprintf("%d bytes", info.size)
+		}
+		fmt.Fprintf(tw, "%s\t%s (%s)\n", file.name, file.path, status)
+	}
+
+	tokenStatus := "unknown"
+	if token := fields["deletetoken"]; token != "" {
+		ttl, err := redis.Int(conn.Do("TTL", pool.key("deletetoken", token)))
+		if err != nil {
+			return xerrors.Errorf("can not receive delete token: %w", err)
+		}
+
+		tokenStatus = "expired"
+		if ttl > 0 {
+			tokenStatus = fmt.Sprintf("valid until %s", time.Now().Add(time.Duration(ttl)*time.Second).Format("2006-01-02 15:04"))
+		}
+	}
+	fmt.Fprintf(tw, "delete token\t%s\n", tokenStatus)
+
+	history, err := pool.entryHistory(id)
+	if err != nil {
+		return err
+	}
+
+	for _, edit := range history {
+		fmt.Fprintf(tw, "edit\t%s %s: %q -> %q\n", edit.Time.Format("2006-01-02 15:04"), edit.Field, edit.Old, edit.New)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,219 @@
+package mailimage
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/xerrors"
+	"gopkg.in/mail.v2"
+)
+
+// mailer delivers outgoing mails.
+type mailer interface {
+	send(from string, to []string, msg io.WriterTo) error
+}
+
+// mailerConfig contains the settings how outgoing mails are delivered.
+type mailerConfig struct {
+	// Type selects the mailer. Supported are "smtp", "sendmail", "file",
+	// "maildir" and "none".
+	Type string `toml:"type"`
+
+	// Settings for the smtp mailer. TLS is one of "none", "opportunistic",
+	// "starttls" or "implicit". CertFile and KeyFile are an optional client
+	// certificate.
+	Host     string `toml:"host"`
+	Port     int    `toml:"port"`
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	TLS      string `toml:"tls"`
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+
+	// Path is the sendmail binary for the sendmail mailer, the file for the
+	// file mailer and the folder for the maildir mailer. The file mailer
+	// writes to stdout, if Path is "-".
+	Path string `toml:"path"`
+}
+
+// newMailer creates the mailer that is selected in the config.
+func newMailer(c mailerConfig) (mailer, error) {
+	switch c.Type {
+	case "smtp":
+		return newSMTPMailer(c)
+
+	case "sendmail":
+		path := c.Path
+		if path == "" {
+			path = "/usr/sbin/sendmail"
+		}
+		return sendmailMailer{path: path}, nil
+
+	case "file":
+		if c.Path == "" {
+			return nil, xerrors.New("mailer.path is required for the file mailer")
+		}
+		return fileMailer{path: c.Path}, nil
+
+	case "maildir":
+		if c.Path == "" {
+			return nil, xerrors.New("mailer.path is required for the maildir mailer")
+		}
+		return maildirMailer{path: c.Path}, nil
+
+	case "none":
+		return noMailer{}, nil
+	}
+	return nil, xerrors.Errorf("invalid value for mailer.type: %s", c.Type)
+}
+
+// outbound is the mailer from the config. It is replaced by LoadConfig.
+var outbound mailer = noMailer{}
+
+// smtpMailer sends mails to a smtp server.
+type smtpMailer struct {
+	dialer *mail.Dialer
+}
+
+func newSMTPMailer(c mailerConfig) (smtpMailer, error) {
+	d := mail.NewDialer(c.Host, c.Port, c.Username, c.Password)
+	d.TLSConfig = &tls.Config{ServerName: c.Host}
+	d.SSL = false
+
+	switch c.TLS {
+	case "none":
+		d.StartTLSPolicy = mail.NoStartTLS
+	case "opportunistic":
+		d.StartTLSPolicy = mail.OpportunisticStartTLS
+	case "starttls":
+		d.StartTLSPolicy = mail.MandatoryStartTLS
+	case "implicit":
+		d.SSL = true
+	default:
+		return smtpMailer{}, xerrors.Errorf("invalid value for mailer.tls: %s", c.TLS)
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return smtpMailer{}, xerrors.Errorf("can not load client certificate: %w", err)
+		}
+		d.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return smtpMailer{dialer: d}, nil
+}
+
+func (m smtpMailer) send(from string, to []string, msg io.WriterTo) error {
+	s, err := m.dialer.Dial()
+	if err != nil {
+		return xerrors.Errorf("can not connect to smtp server: %w", err)
+	}
+	defer s.Close()
+
+	if err := s.Send(from, to, msg); err != nil {
+		return xerrors.Errorf("can not send mail: %w", err)
+	}
+	return nil
+}
+
+// sendmailMailer delivers mails with a sendmail compatible binary.
+type sendmailMailer struct {
+	path string
+}
+
+func (m sendmailMailer) send(from string, to []string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return xerrors.Errorf("can not write mail: %w", err)
+	}
+
+	args := append([]string{"-i", "-f", from, "--"}, to...)
+	cmd := exec.Command(m.path, args...)
+	cmd.Stdin = &buf
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return xerrors.Errorf("can not send mail with %s: %s: %w", m.path, bytes.TrimSpace(out), err)
+	}
+	return nil
+}
+
+// fileMailer appends all mails to a file. It is meant for debugging.
+type fileMailer struct {
+	path string
+}
+
+func (m fileMailer) send(from string, to []string, msg io.WriterTo) error {
+	var w io.Writer = os.Stdout
+	if m.path != "-" {
+		f, err := os.OpenFile(m.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return xerrors.Errorf("can not open mail file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if _, err := msg.WriteTo(w); err != nil {
+		return xerrors.Errorf("can not write mail: %w", err)
+	}
+
+	if _, err := fmt.Fprint(w, "\n\n"); err != nil {
+		return xerrors.Errorf("can not write mail: %w", err)
+	}
+	return nil
+}
+
+// maildirMailer saves each mail as file in a maildir folder.
+type maildirMailer struct {
+	path string
+}
+
+// maildirCounter makes the names of the maildir files unique.
+var maildirCounter uint64
+
+func (m maildirMailer) send(from string, to []string, msg io.WriterTo) error {
+	for _, dir := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(m.path, dir), 0700); err != nil {
+			return xerrors.Errorf("can not create maildir: %w", err)
+		}
+	}
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), atomic.AddUint64(&maildirCounter, 1), host)
+	tmpPath := filepath.Join(m.path, "tmp", name)
+
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return xerrors.Errorf("can not create mail file: %w", err)
+	}
+
+	if _, err := msg.WriteTo(f); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return xerrors.Errorf("can not write mail: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return xerrors.Errorf("can not write mail: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(m.path, "new", name)); err != nil {
+		return xerrors.Errorf("can not deliver mail to maildir: %w", err)
+	}
+	return nil
+}
+
+// noMailer drops all mails.
+type noMailer struct{}
+
+func (noMailer) send(from string, to []string, msg io.WriterTo) error {
+	return nil
+}
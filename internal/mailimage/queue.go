@@ -0,0 +1,402 @@
+package mailimage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// queueConfig contains the settings for the queue of outgoing mails.
+type queueConfig struct {
+	// Interval is the time between two runs of the queue worker.
+	Interval time.Duration `toml:"interval"`
+
+	// RetryMin is the time to wait after the first failed delivery. It is
+	// doubled after each further failure up to RetryMax.
+	RetryMin time.Duration `toml:"retry_min"`
+	RetryMax time.Duration `toml:"retry_max"`
+
+	// MaxAge is the time after which an undeliverable mail is moved to the
+	// dead letters.
+	MaxAge time.Duration `toml:"max_age"`
+}
+
+// queueLease is the time a mail is reserved for one delivery attempt. If the
+// process dies during the delivery, the mail is retried after this time.
+const queueLease = 5 * time.Minute
+
+// queuedMail is a mail in the queue of outgoing mails.
+type queuedMail struct {
+	ID       int
+	From     string
+	To       []string
+	Subject  string
+	Data     []byte
+	Created  time.Time
+	Next     time.Time
+	Attempts int
+	Error    string
+}
+
+// claimScript reserves a queued mail for a delivery attempt, if it is due.
+// Returns 1, if the mail was reserved.
+//
+// KEYS: queue key
+// ARGV: mail id, current time, end of the reservation
+var claimScript = redis.NewScript(1, `
+local next = redis.call("ZSCORE", KEYS[1], ARGV[1])
+if not next or tonumber(next) > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call("ZADD", KEYS[1], ARGV[3], ARGV[1])
+return 1
+`)
+
+// enqueueMail saves a mail into the queue of outgoing mails. It is delivered by
+// the queue worker.
+func (p *pool) enqueueMail(from string, to []string, subject string, msg io.WriterTo) error {
+	var buf bytes.Buffer
+	if _, err := msg.WriteTo(&buf); err != nil {
+		return xerrors.Errorf("can not write mail: %w", err)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	id, err := redis.Int(conn.Do("INCR", p.key("mailq", "last_id")))
+	if err != nil {
+		return xerrors.Errorf("can not get id for queued mail: %w", err)
+	}
+
+	// The mail and its place in the queue are saved together, so there is
+	// no mail that is never delivered.
+	now := time.Now()
+	conn.Send("MULTI")
+	conn.Send(
+		"HMSET",
+		p.key("mailq", strconv.Itoa(id)),
+		"from",
+		from,
+		"to",
+		strings.Join(to, ","),
+		"subject",
+		subject,
+		"data",
+		buf.Bytes(),
+		"created",
+		now.Unix(),
+		"attempts",
+		0,
+	)
+	conn.Send("ZADD", p.key("mailq"), now.Unix(), id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return xerrors.Errorf("can not enqueue mail: %w", err)
+	}
+	return nil
+}
+
+// getQueuedMail gets a mail from the queue.
+func (p *pool) getQueuedMail(id int) (queuedMail, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do(
+		"HMGET",
+		p.key("mailq", strconv.Itoa(id)),
+		"from",
+		"to",
+		"subject",
+		"data",
+		"created",
+		"attempts",
+		"error",
+	))
+	if err != nil {
+		return queuedMail{}, xerrors.Errorf("can not receive queued mail %d: %w", id, err)
+	}
+
+	var m queuedMail
+	var to string
+	var created int64
+	if _, err := redis.Scan(values, &m.From, &to, &m.Subject, &m.Data, &created, &m.Attempts, &m.Error); err != nil {
+		return queuedMail{}, xerrors.Errorf("can not parse queued mail %d: %w", id, err)
+	}
+
+	if m.From == "" {
+		return queuedMail{}, xerrors.Errorf("queued mail %d does not exist", id)
+	}
+
+	m.ID = id
+	m.To = strings.Split(to, ",")
+	m.Created = time.Unix(created, 0)
+	return m, nil
+}
+
+// queuedMails returns the mails in the queue or, if dead is true, the dead
+// letters. Next is set to the next delivery attempt or the time the mail was
+// given up.
+func (p *pool) queuedMails(dead bool) ([]queuedMail, error) {
+	queue := p.key("mailq")
+	if dead {
+		queue = p.key("mailq", "dead")
+	}
+
+	conn := p.Get()
+	values, err := redis.Int64s(conn.Do("ZRANGE", queue, 0, -1, "WITHSCORES"))
+	conn.Close()
+	if err != nil {
+		return nil, xerrors.Errorf("can not receive mail queue: %w", err)
+	}
+
+	var mails []queuedMail
+	for i := 0; i < len(values); i += 2 {
+		m, err := p.getQueuedMail(int(values[i]))
+		if err != nil {
+			return nil, err
+		}
+		m.Next = time.Unix(values[i+1], 0)
+		mails = append(mails, m)
+	}
+	return mails, nil
+}
+
+// deliverQueuedMail tries to deliver one mail from the queue. It does nothing,
+// if the mail is not due or if another process is delivering it. If force is
+// true, the mail is delivered even if it is not due.
+func (p *pool) deliverQueuedMail(m mailer, id int, now time.Time, force bool) (bool, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	due := now.Unix()
+	if force {
+		due = now.Add(queueLease).Unix()
+	}
+
+	claimed, err := redis.Bool(claimScript.Do(conn, p.key("mailq"), id, due, now.Add(queueLease).Unix()))
+	if err != nil {
+		return false, xerrors.Errorf("can not reserve queued mail %d: %w", id, err)
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	qm, err := p.getQueuedMail(id)
+	if err != nil {
+		return false, err
+	}
+
+	sendErr := m.send(qm.From, qm.To, bytes.NewReader(qm.Data))
+	if sendErr == nil {
+		if _, err := conn.Do("ZREM", p.key("mailq"), id); err != nil {
+			return false, xerrors.Errorf("can not remove mail %d from queue: %w", id, err)
+		}
+		if _, err := conn.Do("DEL", p.key("mailq", strconv.Itoa(id))); err != nil {
+			return false, xerrors.Errorf("can not delete queued mail %d: %w", id, err)
+		}
+		return true, nil
+	}
+
+	qm.Attempts++
+	if _, err := conn.Do("HMSET", p.key("mailq", strconv.Itoa(id)), "attempts", qm.Attempts, "error", sendErr.Error()); err != nil {
+		return false, xerrors.Errorf("can not update queued mail %d: %w", id, err)
+	}
+
+	if now.Sub(qm.Created) >= cfg.Queue.MaxAge {
+		if _, err := conn.Do("ZREM", p.key("mailq"), id); err != nil {
+			return false, xerrors.Errorf("can not remove mail %d from queue: %w", id, err)
+		}
+		if _, err := conn.Do("ZADD", p.key("mailq", "dead"), now.Unix(), id); err != nil {
+			return false, xerrors.Errorf("can not move mail %d to dead letters: %w", id, err)
+		}
+		return false, xerrors.Errorf("giving up mail %d after %d attempts: %w", id, qm.Attempts, sendErr)
+	}
+
+	if _, err := conn.Do("ZADD", p.key("mailq"), now.Add(retryDelay(qm.Attempts)).Unix(), id); err != nil {
+		return false, xerrors.Errorf("can not reschedule mail %d: %w", id, err)
+	}
+	return false, xerrors.Errorf("can not deliver mail %d: %w", id, sendErr)
+}
+
+// retryDelay returns the time to wait after the given number of failed
+// delivery attempts.
+func retryDelay(attempts int) time.Duration {
+	delay := cfg.Queue.RetryMin
+	for i := 1; i < attempts && delay < cfg.Queue.RetryMax; i++ {
+		delay *= 2
+	}
+	if delay > cfg.Queue.RetryMax {
+		delay = cfg.Queue.RetryMax
+	}
+	return delay
+}
+
+// processQueue tries to deliver all due mails. If force is true, all mails are
+// delivered even if they are not due. Errors of single mails are logged.
+// Returns the number of delivered and failed mails.
+func (p *pool) processQueue(m mailer, now time.Time, force bool) (int, int, error) {
+	conn := p.Get()
+	max := now.Unix()
+	if force {
+		max = now.Add(queueLease).Unix()
+	}
+	ids, err := redis.Ints(conn.Do("ZRANGEBYSCORE", p.key("mailq"), "-inf", max))
+	conn.Close()
+	if err != nil {
+		return 0, 0, xerrors.Errorf("can not receive due mails: %w", err)
+	}
+
+	var sent, failed int
+	for _, id := range ids {
+		ok, err := p.deliverQueuedMail(m, id, now, force)
+		if err != nil {
+			log.Printf("Mail queue: %v", err)
+			failed++
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	return sent, failed, nil
+}
+
+// requeueDeadMails moves all dead letters back into the queue.
+func (p *pool) requeueDeadMails(now time.Time) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	ids, err := redis.Ints(conn.Do("ZRANGE", p.key("mailq", "dead"), 0, -1))
+	if err != nil {
+		return xerrors.Errorf("can not receive dead letters: %w", err)
+	}
+
+	for _, id := range ids {
+		// Reset created, so the mail is not given up directly again
+		if _, err := conn.Do("HSET", p.key("mailq", strconv.Itoa(id)), "created", now.Unix()); err != nil {
+			return xerrors.Errorf("can not update mail %d: %w", id, err)
+		}
+		if _, err := conn.Do("ZADD", p.key("mailq"), now.Unix(), id); err != nil {
+			return xerrors.Errorf("can not requeue mail %d: %w", id, err)
+		}
+		if _, err := conn.Do("ZREM", p.key("mailq", "dead"), id); err != nil {
+			return xerrors.Errorf("can not remove mail %d from dead letters: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// watchQueue delivers the queued mails. It never returns.
+func watchQueue(p *pool) {
+	ticker := time.NewTicker(cfg.Queue.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, _, err := p.processQueue(outbound, time.Now(), false); err != nil {
+			log.Printf("Can not process mail queue: %v", err)
+		}
+	}
+}
+
+// MailQueue writes the queued mails and the dead letters to w.
+func MailQueue(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	for _, dead := range []bool{false, true} {
+		mails, err := pool.queuedMails(dead)
+		if err != nil {
+			return err
+		}
+
+		title, next := "Queue", "NEXT"
+		if dead {
+			title, next = "Dead letters", "GIVEN UP"
+		}
+		fmt.Fprintf(w, "%s: %d mails\n", title, len(mails))
+		if len(mails) == 0 {
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "ID\tCREATED\t%s\tATTEMPTS\tTO\tSUBJECT\tERROR\n", next)
+		for _, m := range mails {
+			fmt.Fprintf(
+				tw,
+				"%d\t%s\t%s\t%d\t%s\t%s\t%s\n",
+				m.ID,
+				m.Created.Format("2006-01-02 15:04"),
+				m.Next.Format("2006-01-02 15:04"),
+				m.Attempts,
+				strings.Join(m.To, ","),
+				m.Subject,
+				m.Error,
+			)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+// FlushMailQueue tries to deliver all queued mails now. If dead is true, the
+// dead letters are moved back into the queue first.
+func FlushMailQueue(w io.Writer, dead bool) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	now := time.Now()
+	if dead {
+		if err := pool.requeueDeadMails(now); err != nil {
+			return err
+		}
+	}
+
+	sent, failed, err := pool.processQueue(outbound, now, true)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d mails delivered, %d failed\n", sent, failed)
+	return nil
+}
+
+// DeleteQueuedMail removes mails from the queue or the dead letters.
+func DeleteQueuedMail(ids ...int) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	for _, id := range ids {
+		n, err := redis.Int(conn.Do("DEL", pool.key("mailq", strconv.Itoa(id))))
+		if err != nil {
+			return xerrors.Errorf("can not delete queued mail %d: %w", id, err)
+		}
+
+		if n == 0 {
+			return xerrors.Errorf("queued mail %d does not exist", id)
+		}
+
+		if _, err := conn.Do("ZREM", pool.key("mailq"), id); err != nil {
+			return xerrors.Errorf("can not remove mail %d from queue: %w", id, err)
+		}
+		if _, err := conn.Do("ZREM", pool.key("mailq", "dead"), id); err != nil {
+			return xerrors.Errorf("can not remove mail %d from dead letters: %w", id, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package mailimage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEnqueueMail(t *testing.T) {
+	p := setupTest(t, "")
+
+	msg := bytes.NewBufferString("Subject: Kohl\r\n\r\nFrischer Kohl\r\n")
+	if err := p.enqueueMail("mailimage@example.com", []string{"user@example.org"}, "Kohl", msg); err != nil {
+		t.Fatalf("enqueueMail returned error: %v", err)
+	}
+
+	if got := queuedMails(t, p); got != 1 {
+		t.Fatalf("%d mails queued, expected 1", got)
+	}
+
+	m, err := p.getQueuedMail(1)
+	if err != nil {
+		t.Fatalf("getQueuedMail returned error: %v", err)
+	}
+	if m.Subject != "Kohl" || len(m.To) != 1 || m.To[0] != "user@example.org" {
+		t.Errorf("got queued mail %+v", m)
+	}
+}
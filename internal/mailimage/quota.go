@@ -0,0 +1,215 @@
+package mailimage
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// limitConfig contains the maximum number of images that can be posted from
+// one address or one domain. 0 means no limit.
+type limitConfig struct {
+	AddressPerHour int `toml:"address_per_hour"`
+	AddressPerDay  int `toml:"address_per_day"`
+	DomainPerHour  int `toml:"domain_per_hour"`
+	DomainPerDay   int `toml:"domain_per_day"`
+}
+
+// quotaScript checks all counters given as keys against the limits given as
+// arguments. If no limit is reached, all counters are increased. Returns the
+// 1-based indexes of the reached limits.
+//
+// KEYS: counter keys
+// ARGV: the limit of each counter followed by the expire time of each counter
+var quotaScript = redis.NewScript(4, `
+local reached = {}
+for i, k in ipairs(KEYS) do
+	local limit = tonumber(ARGV[i])
+	if limit > 0 and tonumber(redis.call("GET", k) or "0") >= limit then
+		table.insert(reached, i)
+	end
+end
+if #reached > 0 then
+	return reached
+end
+for i, k in ipairs(KEYS) do
+	if tonumber(ARGV[i]) > 0 then
+		redis.call("INCR", k)
+		redis.call("EXPIRE", k, ARGV[#KEYS + i])
+	end
+end
+return reached
+`)
+
+// refundScript decreases the counters given as keys. Counters that expired in
+// the meantime are not created again.
+//
+// KEYS: counter keys
+var refundScript = redis.NewScript(-1, `
+for _, k in ipairs(KEYS) do
+	if tonumber(redis.call("GET", k) or "0") > 0 then
+		redis.call("DECR", k)
+	end
+end
+return 0
+`)
+
+// quotaWindow is one counter of the post limits.
+type quotaWindow struct {
+	name   string
+	value  string
+	period string
+	start  time.Time
+	end    time.Time
+	limit  int
+}
+
+// quotaWindows returns the counters for a post from the address at the given
+// time. Returns nil, if the address is exempt from the limits.
+func (p *pool) quotaWindows(address string, now time.Time) ([]quotaWindow, error) {
+	address = strings.ToLower(address)
+	domain := address[strings.LastIndex(address, "@")+1:]
+
+	rules, err := p.senderRules()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, exempt := range rules.Exempt {
+		if strings.ToLower(exempt) == address {
+			return nil, nil
+		}
+	}
+
+	hour := now.Truncate(time.Hour)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	return []quotaWindow{
+		{"address", address, "hour", hour, hour.Add(time.Hour), p.limits.AddressPerHour},
+		{"address", address, "day", day, day.AddDate(0, 0, 1), p.limits.AddressPerDay},
+		{"domain", domain, "hour", hour, hour.Add(time.Hour), p.limits.DomainPerHour},
+		{"domain", domain, "day", day, day.AddDate(0, 0, 1), p.limits.DomainPerDay},
+	}, nil
+}
+
+// key returns the redis key of the counter.
+func (w quotaWindow) key(p *pool) string {
+	return p.key("quota", w.name, w.value, strconv.FormatInt(w.start.Unix(), 10))
+}
+
+// useQuota counts a new post for the address. If the address or its domain
+// reached a limit, no post is counted and the time is returned when the sender
+// can post again. Returns a zero time on success.
+//
+// counters are the keys of the increased counters. They are given to
+// refundQuota, if the post is not saved.
+func (p *pool) useQuota(address string, now time.Time) (until time.Time, counters []string, err error) {
+	windows, err := p.quotaWindows(address, now)
+	if err != nil || windows == nil {
+		return time.Time{}, nil, err
+	}
+
+	args := make([]interface{}, 0, 3*len(windows))
+	for _, w := range windows {
+		args = append(args, w.key(p))
+	}
+	for _, w := range windows {
+		args = append(args, w.limit)
+	}
+	for _, w := range windows {
+		args = append(args, int(w.end.Sub(now).Seconds())+1)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	reached, err := redis.Ints(quotaScript.Do(conn, args...))
+	if err != nil {
+		return time.Time{}, nil, xerrors.Errorf("can not check quota: %w", err)
+	}
+
+	// The sender can post again, when all reached limits are reset
+	for _, i := range reached {
+		if end := windows[i-1].end; end.After(until) {
+			until = end
+		}
+	}
+
+	if until.IsZero() {
+		for _, w := range windows {
+			if w.limit > 0 {
+				counters = append(counters, w.key(p))
+			}
+		}
+	}
+	return until, counters, nil
+}
+
+// refundQuota takes back a post that was counted by useQuota.
+func (p *pool) refundQuota(counters []string) error {
+	if len(counters) == 0 {
+		return nil
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	args := make([]interface{}, 0, len(counters)+1)
+	args = append(args, len(counters))
+	for _, k := range counters {
+		args = append(args, k)
+	}
+
+	if _, err := refundScript.Do(conn, args...); err != nil {
+		return xerrors.Errorf("can not refund quota: %w", err)
+	}
+	return nil
+}
+
+// quotaStatus is the state of one post limit of an address.
+type quotaStatus struct {
+	Limit string `json:"limit"`
+	Used  int    `json:"used"`
+	Max   int    `json:"max"`
+}
+
+// peekQuota reads the counters of the post limits of an address without
+// changing them. Returns the time when the sender can post again, if a limit
+// is reached. exempt is true, if the address is not limited.
+func (p *pool) peekQuota(address string, now time.Time) (statuses []quotaStatus, until time.Time, exempt bool, err error) {
+	windows, err := p.quotaWindows(address, now)
+	if err != nil {
+		return nil, time.Time{}, false, err
+	}
+	if windows == nil {
+		return nil, time.Time{}, true, nil
+	}
+
+	args := make([]interface{}, len(windows))
+	for i, w := range windows {
+		args[i] = w.key(p)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	used, err := redis.Ints(conn.Do("MGET", args...))
+	if err != nil {
+		return nil, time.Time{}, false, xerrors.Errorf("can not receive quota: %w", err)
+	}
+
+	for i, w := range windows {
+		if w.limit == 0 {
+			continue
+		}
+
+		statuses = append(statuses, quotaStatus{Limit: w.name + " per " + w.period, Used: used[i], Max: w.limit})
+		if used[i] >= w.limit && w.end.After(until) {
+			until = w.end
+		}
+	}
+	return statuses, until, false, nil
+}
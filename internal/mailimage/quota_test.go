@@ -0,0 +1,122 @@
+package mailimage
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestQuotaRefund(t *testing.T) {
+	p := setupTest(t, "[limits]\naddress_per_hour = 1\n")
+	now := time.Now()
+
+	until, counters, err := p.useQuota("user@example.org", now)
+	if err != nil {
+		t.Fatalf("useQuota returned error: %v", err)
+	}
+	if !until.IsZero() || len(counters) != 1 {
+		t.Fatalf("first post: got until %v and counters %v, expected one counter", until, counters)
+	}
+
+	if until, _, _ := p.useQuota("user@example.org", now); until.IsZero() {
+		t.Fatalf("second post was allowed")
+	}
+
+	if err := p.refundQuota(counters); err != nil {
+		t.Fatalf("refundQuota returned error: %v", err)
+	}
+
+	if until, _, _ := p.useQuota("user@example.org", now); !until.IsZero() {
+		t.Errorf("post after refund was rejected until %v", until)
+	}
+}
+
+func TestQuotaRefundExpired(t *testing.T) {
+	p := setupTest(t, "")
+
+	k := p.key("quota", "address", "user@example.org", "0")
+	if err := p.refundQuota([]string{k}); err != nil {
+		t.Fatalf("refundQuota returned error: %v", err)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", k))
+	if err != nil {
+		t.Fatalf("can not check counter: %v", err)
+	}
+	if exists {
+		t.Errorf("refundQuota created an expired counter")
+	}
+}
+
+func TestRollbackRefundsQuota(t *testing.T) {
+	p := setupTest(t, "[limits]\naddress_per_hour = 1\n")
+
+	f, err := newMailFile(p.board)
+	if err != nil {
+		t.Fatalf("can not create mail file: %v", err)
+	}
+	f.Close()
+
+	j, err := newJournal(f)
+	if err != nil {
+		t.Fatalf("can not create journal: %v", err)
+	}
+
+	_, j.Quota, err = p.useQuota("user@example.org", time.Now())
+	if err != nil {
+		t.Fatalf("useQuota returned error: %v", err)
+	}
+
+	if err := j.rollback(p); err != nil {
+		t.Fatalf("rollback returned error: %v", err)
+	}
+
+	if until, _, _ := p.useQuota("user@example.org", time.Now()); !until.IsZero() {
+		t.Errorf("the rolled back post still counts until %v", until)
+	}
+}
+
+func TestRecoverRefundsQuota(t *testing.T) {
+	p := setupTest(t, "[limits]\naddress_per_hour = 1\n")
+
+	f, err := newMailFile(p.board)
+	if err != nil {
+		t.Fatalf("can not create mail file: %v", err)
+	}
+	f.Close()
+
+	j, err := newJournal(f)
+	if err != nil {
+		t.Fatalf("can not create journal: %v", err)
+	}
+
+	_, j.Quota, err = p.useQuota("user@example.org", time.Now())
+	if err != nil {
+		t.Fatalf("useQuota returned error: %v", err)
+	}
+	if err := j.set(stateReceived); err != nil {
+		t.Fatalf("can not write journal: %v", err)
+	}
+
+	// The process dies and leaves the journal behind.
+	j.close()
+
+	if err := p.recoverProgress(ioutil.Discard); err != nil {
+		t.Fatalf("recoverProgress returned error: %v", err)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+	used, err := redis.Int(conn.Do("GET", j.Quota[0]))
+	if err != nil {
+		t.Fatalf("can not receive counter: %v", err)
+	}
+	if used != 0 {
+		t.Errorf("counter is %d after recover, expected 0", used)
+	}
+}
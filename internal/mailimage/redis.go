@@ -1,9 +1,12 @@
 package mailimage
 
 import (
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"math/rand"
-	"os"
+	"net"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
@@ -13,19 +16,301 @@ import (
 	"golang.org/x/xerrors"
 )
 
+// pool is the connection to redis for one board. The boards share the
+// connections, but use different keys.
 type pool struct {
-	redis.Pool
+	*redis.Pool
+	*board
+
+	// cache is used by entryPage, if it is not nil.
+	cache *entryCache
+}
+
+// redisConfig contains the settings for the connection to redis.
+type redisConfig struct {
+	// URL is the address of redis. Supported are
+	// redis://[user:password@]host:port/db, rediss:// for tls and
+	// unix:///path/to/socket?db=0. If sentinels are used, the host is
+	// ignored.
+	URL string `toml:"url"`
+
+	// Username and Password are used for AUTH. They replace the user and
+	// password from the URL. DB replaces the database from the URL, if it is
+	// not 0.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+	DB       int    `toml:"db"`
+
+	// CAFile is a file with the certificates to verify the server with tls.
+	// TLSSkipVerify disables the verification.
+	CAFile        string `toml:"ca_file"`
+	TLSSkipVerify bool   `toml:"tls_skip_verify"`
+
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	ReadTimeout    time.Duration `toml:"read_timeout"`
+	WriteTimeout   time.Duration `toml:"write_timeout"`
+
+	// Sentinels are the addresses of redis sentinels. If they are set, the
+	// address of the master with the name SentinelMaster is received from
+	// them.
+	Sentinels        []string `toml:"sentinels"`
+	SentinelMaster   string   `toml:"sentinel_master"`
+	SentinelPassword string   `toml:"sentinel_password"`
+
+	// Prefix is put before all keys, so more than one board can use the same
+	// redis database.
+	Prefix string `toml:"prefix"`
 }
 
-// newPool creates a new redis pool
-func newPool(addr string) (*pool, error) {
-	p := pool{redis.Pool{
+// redisTarget is the parsed URL of a redisConfig.
+type redisTarget struct {
+	network  string
+	address  string
+	useTLS   bool
+	username string
+	password string
+	db       int
+}
+
+// target parses the URL of the config.
+func (c redisConfig) target() (redisTarget, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return redisTarget{}, xerrors.Errorf("invalid value for redis.url: %w", err)
+	}
+
+	t := redisTarget{network: "tcp", address: u.Host}
+	switch u.Scheme {
+	case "redis", "rediss":
+		t.useTLS = u.Scheme == "rediss"
+		if u.Port() == "" {
+			t.address = net.JoinHostPort(u.Hostname(), "6379")
+		}
+
+		if db := strings.Trim(u.Path, "/"); db != "" {
+			if t.db, err = strconv.Atoi(db); err != nil {
+				return redisTarget{}, xerrors.Errorf("invalid database in redis.url: %s", db)
+			}
+		}
+
+	case "unix":
+		t.network, t.address = "unix", u.Path
+		if db := u.Query().Get("db"); db != "" {
+			if t.db, err = strconv.Atoi(db); err != nil {
+				return redisTarget{}, xerrors.Errorf("invalid database in redis.url: %s", db)
+			}
+		}
+
+	default:
+		return redisTarget{}, xerrors.Errorf("invalid value for redis.url: unsupported scheme %q", u.Scheme)
+	}
+
+	if u.User != nil {
+		t.username = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+
+	if c.Username != "" {
+		t.username = c.Username
+	}
+	if c.Password != "" {
+		t.password = c.Password
+	}
+	if c.DB != 0 {
+		t.db = c.DB
+	}
+	return t, nil
+}
+
+// dialOptions returns the options for connections to redis and to the
+// sentinels.
+func (c redisConfig) dialOptions(useTLS bool) ([]redis.DialOption, error) {
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(c.ConnectTimeout),
+		redis.DialReadTimeout(c.ReadTimeout),
+		redis.DialWriteTimeout(c.WriteTimeout),
+	}
+
+	if !useTLS {
+		return options, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, xerrors.Errorf("can not read redis.ca_file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, xerrors.Errorf("redis.ca_file %s contains no certificates", c.CAFile)
+		}
+	}
+
+	return append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig)), nil
+}
+
+// dial opens a new connection to redis. With sentinels, it connects to the
+// current master.
+func (c redisConfig) dial() (redis.Conn, error) {
+	t, err := c.target()
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := c.dialOptions(t.useTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	address := t.address
+	if len(c.Sentinels) > 0 {
+		if address, err = c.masterAddress(options); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := redis.Dial(t.network, address, options...)
+	if err != nil {
+		return nil, xerrors.Errorf("can not connect to redis at %s: %w", address, err)
+	}
+
+	if t.password != "" {
+		args := []interface{}{t.password}
+		if t.username != "" {
+			args = []interface{}{t.username, t.password}
+		}
+
+		if _, err := conn.Do("AUTH", args...); err != nil {
+			conn.Close()
+			return nil, xerrors.Errorf("can not authenticate to redis: %w", err)
+		}
+	}
+
+	if t.db != 0 {
+		if _, err := conn.Do("SELECT", t.db); err != nil {
+			conn.Close()
+			return nil, xerrors.Errorf("can not select redis database %d: %w", t.db, err)
+		}
+	}
+
+	if len(c.Sentinels) > 0 {
+		if err := checkMaster(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// masterAddress asks the sentinels for the address of the master. The first
+// sentinel that answers is used.
+func (c redisConfig) masterAddress(options []redis.DialOption) (string, error) {
+	if c.SentinelPassword != "" {
+		options = append(options, redis.DialPassword(c.SentinelPassword))
+	}
+
+	var lastErr error
+	for _, sentinel := range c.Sentinels {
+		conn, err := redis.Dial("tcp", sentinel, options...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		values, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", c.SentinelMaster))
+		conn.Close()
+		if err != nil && err != redis.ErrNil {
+			lastErr = err
+			continue
+		}
+
+		if len(values) != 2 {
+			lastErr = xerrors.Errorf("sentinel %s does not know the master %s", sentinel, c.SentinelMaster)
+			continue
+		}
+		return net.JoinHostPort(values[0], values[1]), nil
+	}
+	return "", xerrors.Errorf("can not get the redis master from the sentinels: %w", lastErr)
+}
+
+// checkMaster returns an error, if the connection is not to a redis master.
+// After a failover, the old master becomes a replica.
+func checkMaster(conn redis.Conn) error {
+	values, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return xerrors.Errorf("can not receive role of redis: %w", err)
+	}
+
+	if len(values) == 0 {
+		return xerrors.New("can not receive role of redis")
+	}
+
+	if role, _ := redis.String(values[0], nil); role != "master" {
+		return xerrors.Errorf("redis is a %s and not the master", role)
+	}
+	return nil
+}
+
+// newPool creates a new redis pool for the board from currentBoard.
+func newPool(c redisConfig) (*pool, error) {
+	b, err := currentBoard()
+	if err != nil {
+		return nil, err
+	}
+	return newPoolForBoard(c, b)
+}
+
+// newPoolForBoard creates a new redis pool for a board.
+func newPoolForBoard(c redisConfig, b *board) (*pool, error) {
+	rp, err := dialRedis(c)
+	if err != nil {
+		return nil, err
+	}
+	return newBoardPool(rp, b)
+}
+
+// newBoardPool creates the pool of a board from the connections of dialRedis.
+func newBoardPool(rp *redis.Pool, b *board) (*pool, error) {
+	p := &pool{Pool: rp, board: b}
+
+	// Save the schema version of a new database
+	if _, err := p.schemaVersion(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newReadOnlyPool creates the pool of a board like newPoolForBoard, but it
+// does not save the schema version of a new database.
+func newReadOnlyPool(c redisConfig, b *board) (*pool, error) {
+	rp, err := dialRedis(c)
+	if err != nil {
+		return nil, err
+	}
+	return &pool{Pool: rp, board: b}, nil
+}
+
+// dialRedis creates the connections to redis and tests them.
+func dialRedis(c redisConfig) (*redis.Pool, error) {
+	p := &redis.Pool{
 		MaxActive:   100,
 		Wait:        true,
 		MaxIdle:     10,
 		IdleTimeout: 240 * time.Second,
-		Dial:        func() (redis.Conn, error) { return redis.Dial("tcp", addr) },
-	}}
+		Dial:        c.dial,
+	}
+
+	if len(c.Sentinels) > 0 {
+		// Find connections to an old master after a failover
+		p.TestOnBorrow = func(conn redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Second {
+				return nil
+			}
+			return checkMaster(conn)
+		}
+	}
 
 	// Test connection
 	conn := p.Get()
@@ -35,23 +320,19 @@ func newPool(addr string) (*pool, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &p, nil
+	return p, nil
 }
 
-// postEntry saves an new entry to the database
-// Returns the new id and the delete token
-func (p *pool) postEntry(fromName, fromAddr, subject, text, imageExt string) (int, string, error) {
+// postEntry saves an new entry with an id from getNewID to the database
+// Returns the delete token
+func (p *pool) postEntry(id int, fromName, fromAddr, subject, text, imageExt string) (string, error) {
 	conn := p.Get()
 	defer conn.Close()
 
-	id, err := p.getNewID()
-	if err != nil {
-		return 0, "", err
-	}
-
-	_, err = conn.Do(
+	now := time.Now()
+	_, err := conn.Do(
 		"HMSET",
-		key("entry", strconv.Itoa(id)),
+		p.key("entry", strconv.Itoa(id)),
 		"from",
 		fromName,
 		"mail",
@@ -63,80 +344,246 @@ func (p *pool) postEntry(fromName, fromAddr, subject, text, imageExt string) (in
 		"fileext",
 		imageExt,
 		"created",
-		time.Now().Format("2006-01-02 15:04:05"),
+		formatTime(now),
 	)
 	if err != nil {
-		return 0, "", xerrors.Errorf("can not post entry: %w", err)
+		return "", xerrors.Errorf("can not post entry: %w", err)
 	}
 
-	if _, err = conn.Do("SADD", key("entries"), id); err != nil {
-		return 0, "", xerrors.Errorf("can not save entry id: %s", err)
+	if _, err = conn.Do("ZADD", p.key("entries"), now.Unix(), id); err != nil {
+		return "", xerrors.Errorf("can not save entry id: %s", err)
+	}
+
+	if err := p.entriesChanged(conn); err != nil {
+		return "", err
 	}
 
 	token, err := p.createDeleteToken(id)
 	if err != nil {
-		return 0, "", err
+		return "", err
+	}
+	return token, nil
+}
+
+// removeEntry removes an entry from redis. It does not fail, if the entry does
+// not exist.
+func (p *pool) removeEntry(id int) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("ZREM", p.key("entries"), id); err != nil {
+		return xerrors.Errorf("can not delete entry id: %w", err)
 	}
-	return id, token, nil
+
+	if _, err := conn.Do("ZREM", p.key("trash"), id); err != nil {
+		return xerrors.Errorf("can not remove entry %d from trash: %w", id, err)
+	}
+
+	if _, err := conn.Do("DEL", p.key("entry", strconv.Itoa(id)), p.key("entry", strconv.Itoa(id), "history")); err != nil {
+		return xerrors.Errorf("can not delete entry: %w", err)
+	}
+	return p.entriesChanged(conn)
 }
 
-// listEntries gets all enties from the database
+// entryFields are the fields of an entry that are read by getEntry.
+var entryFields = []interface{}{"from", "subject", "text", "fileext", "created", "mail", "expires", "deleted", "blob"}
+
+// listEntries gets all enties from the database, the oldest first.
 func (p *pool) listEntries() ([]entry, error) {
 	conn := p.Get()
 	defer conn.Close()
 
-	ids, err := redis.Ints(conn.Do("SMEMBERS", key("entries")))
+	ids, err := redis.Ints(conn.Do("ZRANGE", p.key("entries"), 0, -1))
 	if err != nil {
 		return nil, xerrors.Errorf("can not receive ids: %w", err)
 	}
+	return p.getEntries(ids)
+}
+
+// entryPage returns count entries, the newest first, after skipping offset
+// entries. A count of 0 returns all entries. The second return value is the
+// number of all entries.
+func (p *pool) entryPage(offset, count int) ([]entry, int, error) {
+	if p.cache != nil {
+		return p.cache.page(p, offset, count)
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	stop := offset + count - 1
+	if count == 0 {
+		stop = -1
+	}
+
+	conn.Send("MULTI")
+	conn.Send("ZCARD", p.key("entries"))
+	conn.Send("ZREVRANGE", p.key("entries"), offset, stop)
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, 0, xerrors.Errorf("can not receive ids: %w", err)
+	}
+
+	total, err := redis.Int(values[0], nil)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("can not receive number of entries: %w", err)
+	}
+
+	ids, err := redis.Ints(values[1], nil)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("can not receive ids: %w", err)
+	}
+
+	entries, err := p.getEntries(ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, total, nil
+}
+
+// getEntries gets the entries with the ids in the same order. The entries are
+// requested in one pipeline. Entries that were deleted in the meantime are
+// skipped.
+func (p *pool) getEntries(ids []int) ([]entry, error) {
+	conn := p.Get()
+	defer conn.Close()
 
-	var entries []entry
 	for _, id := range ids {
-		values, err := redis.Strings(conn.Do(
-			"HMGET",
-			key("entry", strconv.Itoa(id)),
-			"from",
-			"subject",
-			"text",
-			"fileext",
-			"created",
-		))
+		conn.Send("HMGET", append([]interface{}{p.key("entry", strconv.Itoa(id))}, entryFields...)...)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, xerrors.Errorf("can not request entries: %w", err)
+	}
+
+	entries := make([]entry, 0, len(ids))
+	for _, id := range ids {
+		values, err := redis.Strings(conn.Receive())
 		if err != nil {
 			return nil, xerrors.Errorf("can not receice entry %d: %w", id, err)
 		}
 
-		created, err := time.Parse("2006-01-02 15:04:05", values[4])
+		e, err := parseEntry(id, values)
+		if err == errUnknownImage {
+			continue
+		}
 		if err != nil {
-			return nil, xerrors.Errorf("can not parse created time: %w", err)
+			return nil, xerrors.Errorf("entry %d: %w", id, err)
 		}
-
-		entries = append(entries, entry{
-			ID:        id,
-			From:      values[0],
-			Subject:   values[1],
-			Text:      values[2],
-			Extension: values[3],
-			Created:   created.Format("2006-01-02 15:04"),
-		})
+		entries = append(entries, e)
 	}
 	return entries, nil
 }
 
+// getEntry gets one entry from the database
+func (p *pool) getEntry(id int) (entry, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("HMGET", append([]interface{}{p.key("entry", strconv.Itoa(id))}, entryFields...)...))
+	if err != nil {
+		return entry{}, xerrors.Errorf("can not receice entry %d: %w", id, err)
+	}
+	return parseEntry(id, values)
+}
+
+// parseEntry creates an entry from the values of the entryFields.
+func parseEntry(id int, values []string) (entry, error) {
+	// The entry is unknown in redis or in the trash
+	if values[3] == "" || values[7] != "" {
+		return entry{}, errUnknownImage
+	}
+
+	created, err := parseTime(values[4])
+	if err != nil {
+		return entry{}, xerrors.Errorf("can not parse created time: %w", err)
+	}
+
+	var expires time.Time
+	if values[6] != "" {
+		expires, err = parseTime(values[6])
+		if err != nil {
+			return entry{}, xerrors.Errorf("can not parse expire time: %w", err)
+		}
+	}
+
+	return entry{
+		ID:        id,
+		From:      values[0],
+		Subject:   values[1],
+		Text:      values[2],
+		Extension: values[3],
+		Created:   created.Format("2006-01-02 15:04"),
+		Date:      created,
+		Mail:      values[5],
+		Expires:   expires,
+		Blob:      values[8],
+	}, nil
+}
+
+// entriesChanged marks that the listed entries were changed, so the entry
+// caches of all processes are reloaded. In a transaction, use
+// conn.Send("INCR", p.generationKey()) instead.
+func (p *pool) entriesChanged(conn redis.Conn) error {
+	if _, err := conn.Do("INCR", p.generationKey()); err != nil {
+		return xerrors.Errorf("can not increment entry generation: %w", err)
+	}
+	return nil
+}
+
+// generationKey returns the key of the counter that is incremented on every
+// change of the listed entries.
+func (p *pool) generationKey() string {
+	return p.key("entries", "generation")
+}
+
+// entryExists returns true, if there is an entry with the id. Entries in the
+// trash exist.
+func (p *pool) entryExists(id int) (bool, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	exists, err := redis.Bool(conn.Do("EXISTS", p.key("entry", strconv.Itoa(id))))
+	if err != nil {
+		return false, xerrors.Errorf("can not check entry %d: %w", id, err)
+	}
+	return exists, nil
+}
+
+// entryCreated returns the time when an entry was created.
+func (p *pool) entryCreated(id int) (time.Time, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	value, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "created"))
+	if err == redis.ErrNil {
+		return time.Time{}, errUnknownImage
+	}
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("can not receive entry %d: %w", id, err)
+	}
+
+	created, err := parseTime(value)
+	if err != nil {
+		return time.Time{}, xerrors.Errorf("can not parse created time: %w", err)
+	}
+	return created, nil
+}
+
 // getImage gets an image and the file extension for an id
 func (p *pool) getExtension(id int) (string, error) {
 	conn := p.Get()
 	defer conn.Close()
 
-	ext, err := redis.String(conn.Do("HGET", key("entry", strconv.Itoa(id)), "fileext"))
+	values, err := redis.Strings(conn.Do("HMGET", p.key("entry", strconv.Itoa(id)), "fileext", "deleted"))
 	if err != nil {
 		return "", xerrors.Errorf("can not get extension for image with id %d: %w", id, err)
 	}
 
-	// The image is unknown in redis
-	if ext == "" {
+	// The image is unknown in redis or in the trash
+	if values[0] == "" || values[1] != "" {
 		return "", errUnknownImage
 	}
-	return ext, nil
+	return values[0], nil
 }
 
 // createDeleteToken saves a new delete token into the database
@@ -147,19 +594,24 @@ func (p *pool) createDeleteToken(id int) (string, error) {
 	token := genToken()
 	// TODO: Test that token does not exist
 
-	_, err := conn.Do("SET", key("deletetoken", token), id, "EX", tokenExpire)
+	_, err := conn.Do("SET", p.key("deletetoken", token), id, "EX", tokenExpire)
 	if err != nil {
 		return "", xerrors.Errorf("can not generate delete token: %w", err)
 	}
+
+	// Remember the token to show its status
+	if _, err := conn.Do("HSET", p.key("entry", strconv.Itoa(id)), "deletetoken", token); err != nil {
+		return "", xerrors.Errorf("can not save delete token: %w", err)
+	}
 	return token, nil
 }
 
-// deleteFromToken deletes a entry from a delete token
+// deleteFromToken moves an entry into the trash from a delete token
 func (p *pool) deleteFromToken(token string) error {
 	conn := p.Get()
 	defer conn.Close()
 
-	id, err := redis.Int(conn.Do("GET", key("deletetoken", token)))
+	id, err := redis.Int(conn.Do("GET", p.key("deletetoken", token)))
 	if err != nil {
 		return xerrors.Errorf("can not find id for token: %w", err)
 	}
@@ -168,41 +620,51 @@ func (p *pool) deleteFromToken(token string) error {
 		return errUnknownImage
 	}
 
-	return p.deleteFromID(id)
+	return p.trashEntry(id)
 }
 
 // deleteFromID deletes an entry from an id
+//
+// All parts of the entry are deleted, even if one of them fails or does not
+// exist. Returns the first error or errUnknownImage, if the entry did not
+// exist in redis.
 func (p *pool) deleteFromID(id int) error {
 	conn := p.Get()
 	defer conn.Close()
 
-	ext, err := redis.String(conn.Do("HGET", key("entry", strconv.Itoa(id)), "fileext"))
-	if err != nil {
+	ext, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "fileext"))
+	if err != nil && err != redis.ErrNil {
 		return xerrors.Errorf("can not get image extension %d: %w", id, err)
 	}
 
-	// Delete from list
-	if _, err := conn.Do("SREM", key("entries"), id); err != nil {
-		return xerrors.Errorf("can not delete entry id: %w", err)
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	// Delete from redis
-	if _, err := conn.Do("DEL", key("entry", strconv.Itoa(id))); err != nil {
-		return xerrors.Errorf("can not delete entry: %w", err)
+	// Delete from redis. The blob is deleted, if no other entry uses it.
+	keep(p.unlinkBlob(id))
+	keep(p.removeEntry(id))
+
+	// Delete files from the store
+	files := []string{path.Join("success", strconv.Itoa(id))}
+	if ext != "" {
+		// The image of an entry that is not migrated to the blob store
+		files = append(files, legacyImageNames(id, ext)...)
 	}
 
-	// Delete image from disk
-	filePath := path.Join(mailimagePath(), "images", fmt.Sprintf("%d%s", id, ext))
-	if err := os.Remove(filePath); err != nil {
-		return xerrors.Errorf("can not delete image from disk: %w", err)
+	for _, file := range files {
+		if err := p.store.remove(file); err != nil {
+			keep(xerrors.Errorf("can not delete %s from the store: %w", file, err))
+		}
 	}
 
-	// Delete mail fom disk
-	filePath = path.Join(mailimagePath(), "success", strconv.Itoa(id))
-	if err := os.Remove(filePath); err != nil {
-		return xerrors.Errorf("can not delete file from disk: %w", err)
+	if ext == "" {
+		keep(errUnknownImage)
 	}
-	return nil
+	return firstErr
 }
 
 // getNewID creates a new database id
@@ -210,18 +672,13 @@ func (p *pool) getNewID() (int, error) {
 	conn := p.Get()
 	defer conn.Close()
 
-	id, err := redis.Int(conn.Do("INCR", key("last_id")))
+	id, err := redis.Int(conn.Do("INCR", p.key("last_id")))
 	if err != nil {
 		return 0, xerrors.Errorf("can not get new id: %w", err)
 	}
 	return id, nil
 }
 
-// key creates a redis key with a prefix from a list of strings
-func key(keys ...string) string {
-	return fmt.Sprintf("%s:%s", "mailimage", strings.Join(keys, ":"))
-}
-
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
 func genToken() string {
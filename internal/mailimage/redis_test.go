@@ -0,0 +1,113 @@
+package mailimage
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// benchmarkEntries is the number of entries that are created for the
+// benchmarks.
+const benchmarkEntries = 500
+
+// setupBenchmark creates benchmarkEntries entries directly in redis. The
+// benchmark is skipped, if redis is not available.
+func setupBenchmark(b *testing.B) *pool {
+	b.Helper()
+
+	p := setupTest(b, "")
+
+	conn := p.Get()
+	defer conn.Close()
+
+	created := time.Date(2019, 5, 19, 22, 17, 1, 0, time.UTC)
+	for id := 1; id <= benchmarkEntries; id++ {
+		conn.Send("HMSET", p.key("entry", strconv.Itoa(id)),
+			"from", "user@example.org",
+			"subject", "Kohl "+strconv.Itoa(id),
+			"text", "Frischer Kohl",
+			"fileext", ".png",
+			"created", formatTime(created.Add(time.Duration(id)*time.Minute)),
+			"blob", blobHash([]byte(strconv.Itoa(id))),
+		)
+		conn.Send("ZADD", p.key("entries"), created.Unix()+int64(id)*60, id)
+	}
+	if _, err := conn.Do(""); err != nil {
+		b.Fatalf("can not create entries: %v", err)
+	}
+	return p
+}
+
+// getEntriesSingle reads the entries with one request per entry like before
+// getEntries used a pipeline.
+func (p *pool) getEntriesSingle(ids []int) ([]entry, error) {
+	entries := make([]entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := p.getEntry(id)
+		if err == errUnknownImage {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// benchmarkIDs returns the ids of a range of the entries, the newest first.
+func benchmarkIDs(b *testing.B, p *pool, start, stop int) []int {
+	b.Helper()
+
+	conn := p.Get()
+	defer conn.Close()
+
+	ids, err := redis.Ints(conn.Do("ZREVRANGE", p.key("entries"), start, stop))
+	if err != nil {
+		b.Fatalf("can not receive ids: %v", err)
+	}
+	return ids
+}
+
+func BenchmarkEntryPage(b *testing.B) {
+	p := setupBenchmark(b)
+	const pageSize = 50
+
+	b.Run("pipeline", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := p.entryPage(0, pageSize); err != nil {
+				b.Fatalf("entryPage returned error: %v", err)
+			}
+		}
+	})
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := p.getEntriesSingle(benchmarkIDs(b, p, 0, pageSize-1)); err != nil {
+				b.Fatalf("getEntry returned error: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkListEntries(b *testing.B) {
+	p := setupBenchmark(b)
+
+	b.Run("pipeline", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := p.listEntries(); err != nil {
+				b.Fatalf("listEntries returned error: %v", err)
+			}
+		}
+	})
+
+	b.Run("single", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := p.getEntriesSingle(benchmarkIDs(b, p, 0, -1)); err != nil {
+				b.Fatalf("getEntry returned error: %v", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package mailimage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ReprocessOptions selects the mails for Reprocess.
+type ReprocessOptions struct {
+	// Folder is the folder with the mails. Supported are "error" and
+	// "invalid".
+	Folder string
+
+	// Since skips mails that where received before this time.
+	Since time.Time
+
+	// Files are the mails that are reprocessed. A file can be the name of a
+	// mail in Folder or the path of a file outside of MAILIMAGE_PATH. Files
+	// given by path are never removed. If it is empty, all mails in Folder
+	// are reprocessed.
+	Files []string
+
+	// DryRun only prints the mails that would be reprocessed.
+	DryRun bool
+
+	// NoReply suppresses the responses to the senders.
+	NoReply bool
+}
+
+// Reprocess inserts stored mails again and writes a report for each mail to
+// w. A mail from Folder is removed, after it was saved again.
+func Reprocess(w io.Writer, opts ReprocessOptions) error {
+	switch opts.Folder {
+	case "error", "invalid":
+	default:
+		return xerrors.Errorf("can not reprocess mails from folder %s", opts.Folder)
+	}
+
+	b, err := currentBoard()
+	if err != nil {
+		return err
+	}
+
+	files, err := b.reprocessFiles(opts)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if opts.DryRun {
+			fmt.Fprintf(w, "%s: would be reprocessed\n", file)
+			continue
+		}
+
+		result, err := b.reprocessFile(file, opts.NoReply)
+		switch {
+		case err != nil && result.folder == "":
+			fmt.Fprintf(w, "%s: not processed: %v\n", file, err)
+		case err != nil:
+			fmt.Fprintf(w, "%s: %s: %v\n", file, result.folder, err)
+		case result.id != 0:
+			fmt.Fprintf(w, "%s: success, image %d\n", file, result.id)
+		default:
+			fmt.Fprintf(w, "%s: %s\n", file, result.folder)
+		}
+	}
+	return nil
+}
+
+// reprocessMail is a mail that is reprocessed. It is a file on the local disk
+// or a file in the store.
+type reprocessMail struct {
+	name  string
+	local bool
+}
+
+func (m reprocessMail) String() string {
+	return m.name
+}
+
+// reprocessFiles returns the mails of the board that should be reprocessed.
+func (b *board) reprocessFiles(opts ReprocessOptions) ([]reprocessMail, error) {
+	var files []reprocessMail
+	if len(opts.Files) > 0 {
+		for _, file := range opts.Files {
+			m, modTime, err := b.findReprocessMail(opts.Folder, file)
+			if err != nil {
+				return nil, err
+			}
+
+			if modTime.Before(opts.Since) {
+				continue
+			}
+			files = append(files, m)
+		}
+		return files, nil
+	}
+
+	infos, err := b.store.list(opts.Folder)
+	if err != nil {
+		return nil, xerrors.Errorf("can not read folder %s: %w", opts.Folder, err)
+	}
+
+	for _, info := range infos {
+		if info.modTime.Before(opts.Since) {
+			continue
+		}
+		files = append(files, reprocessMail{name: info.name})
+	}
+	return files, nil
+}
+
+// findReprocessMail returns a mail by its name in folder or by its path on the
+// local disk. Returns the mail and the time it was received.
+//
+// Paths below the folder of the board are not accepted, because the mails
+// there belong to other folders. The unrouted folder is the exception, if
+// the board uses MAILIMAGE_PATH itself.
+func (b *board) findReprocessMail(folder, file string) (reprocessMail, time.Time, error) {
+	name := path.Join(folder, file)
+	if strings.HasPrefix(name, folder+"/") {
+		info, err := b.store.stat(name)
+		if err == nil {
+			return reprocessMail{name: name}, info.modTime, nil
+		}
+		if !os.IsNotExist(err) {
+			return reprocessMail{}, time.Time{}, xerrors.Errorf("can not find mail %s: %w", file, err)
+		}
+	}
+
+	info, err := os.Stat(file)
+	if err != nil {
+		return reprocessMail{}, time.Time{}, xerrors.Errorf("can not find mail %s in folder %s or on disk: %w", file, folder, err)
+	}
+
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return reprocessMail{}, time.Time{}, xerrors.Errorf("can not find mail %s: %w", file, err)
+	}
+
+	unrouted, _ := filepath.Abs(filepath.Join(mailimagePath(), unroutedFolder))
+	if root, err := filepath.Abs(b.path); err == nil && isBelow(abs, root) && !isBelow(abs, unrouted) {
+		return reprocessMail{}, time.Time{}, xerrors.Errorf("%s is inside the folder of the board, give the name of a mail in the folder %s", file, folder)
+	}
+	return reprocessMail{name: abs, local: true}, info.ModTime(), nil
+}
+
+// reprocessFile inserts one stored mail again. A stored mail is removed, if it
+// was saved again. Stored mails are inserted into the board again, local files
+// are sorted to a board by their recipients, if no board was selected. Local
+// files are never removed.
+func (b *board) reprocessFile(m reprocessMail, noReply bool) (insertResult, error) {
+	var f io.ReadCloser
+	var err error
+	if m.local {
+		f, err = os.Open(m.name)
+	} else {
+		f, err = b.store.open(m.name)
+	}
+	if err != nil {
+		return insertResult{}, xerrors.Errorf("can not open mail: %w", err)
+	}
+	defer f.Close()
+
+	opts := insertOptions{board: b, noReply: noReply}
+	if m.local {
+		opts.board = selected
+	}
+
+	result, err := insert(f, opts)
+
+	// If the mail is still in the progress folder, the rollback failed and
+	// the original is the only complete copy.
+	if m.local || result.folder == "" || result.folder == "progress" {
+		return result, err
+	}
+
+	if e := b.store.remove(m.name); e != nil {
+		return result, xerrors.Errorf("can not remove reprocessed mail: %w", e)
+	}
+	return result, err
+}
+
+// isBelow returns true, if the path name is dir or a path inside dir.
+func isBelow(name, dir string) bool {
+	return name == dir || strings.HasPrefix(name, dir+string(filepath.Separator))
+}
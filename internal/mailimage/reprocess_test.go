@@ -0,0 +1,72 @@
+package mailimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReprocessKeepsLocalFiles(t *testing.T) {
+	p := setupTest(t, "")
+
+	local := filepath.Join(t.TempDir(), "notes.eml")
+	if err := ioutil.WriteFile(local, testMail(t, "user@example.org", ""), 0644); err != nil {
+		t.Fatalf("can not write mail: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Reprocess(&out, ReprocessOptions{Folder: "error", Files: []string{local}, NoReply: true}); err != nil {
+		t.Fatalf("Reprocess returned error: %v", err)
+	}
+
+	if _, err := os.Stat(local); err != nil {
+		t.Errorf("local file was removed: %v", err)
+	}
+
+	if _, err := p.store.stat("success/1"); err != nil {
+		t.Errorf("mail was not inserted: %s", out.String())
+	}
+}
+
+func TestReprocessRejectsPathsInMailFolder(t *testing.T) {
+	p := setupTest(t, "")
+
+	if err := p.store.write("success/12", testMail(t, "user@example.org", "")); err != nil {
+		t.Fatalf("can not write mail: %v", err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("can not get working directory: %v", err)
+	}
+	if err := os.Chdir(p.path); err != nil {
+		t.Fatalf("can not change directory: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	if err := Reprocess(ioutil.Discard, ReprocessOptions{Folder: "error", Files: []string{"success/12"}}); err == nil {
+		t.Errorf("Reprocess accepted a mail from the success folder")
+	}
+
+	if _, err := p.store.stat("success/12"); err != nil {
+		t.Errorf("mail in the success folder was removed: %v", err)
+	}
+}
+
+func TestReprocessRemovesStoredMail(t *testing.T) {
+	p := setupTest(t, "")
+
+	if err := p.store.write("error/1234", testMail(t, "user@example.org", "")); err != nil {
+		t.Fatalf("can not write mail: %v", err)
+	}
+
+	if err := Reprocess(ioutil.Discard, ReprocessOptions{Folder: "error", Files: []string{"1234"}, NoReply: true}); err != nil {
+		t.Fatalf("Reprocess returned error: %v", err)
+	}
+
+	if _, err := p.store.stat("error/1234"); !os.IsNotExist(err) {
+		t.Errorf("reprocessed mail was not removed: %v", err)
+	}
+}
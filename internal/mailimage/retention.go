@@ -0,0 +1,302 @@
+package mailimage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// retentionConfig contains the settings when entries expire.
+type retentionConfig struct {
+	// MaxAge is the time after which an entry expires. 0 means that entries
+	// do not expire because of their age.
+	MaxAge time.Duration `toml:"max_age"`
+
+	// MaxEntries is the maximum number of entries. If there are more entries,
+	// the oldest ones expire. 0 means no limit.
+	MaxEntries int `toml:"max_entries"`
+
+	// SenderExpiry allows senders to set the lifetime of an entry with a tag
+	// in the subject like "[7d]". It can not be longer than MaxAge.
+	SenderExpiry bool `toml:"sender_expiry"`
+
+	// Action defines what happens with expired entries. "delete" deletes them
+	// with all files, "archive" moves the image and the mail into the folder
+	// archive before the entry is deleted.
+	Action string `toml:"action"`
+
+	// Interval is the time between two runs of the janitor in serve.
+	Interval time.Duration `toml:"interval"`
+
+	// NotifyBefore is the time before the expiry, when the sender gets a
+	// notice. 0 means that no notice is send. Entries that are over
+	// MaxEntries expire at once without a notice.
+	NotifyBefore time.Duration `toml:"notify_before"`
+}
+
+// enabled returns true, if entries can expire.
+func (c retentionConfig) enabled() bool {
+	return c.MaxAge > 0 || c.MaxEntries > 0 || c.SenderExpiry
+}
+
+// lifetimeTag matches the lifetime of an entry in the subject. The units are
+// h (hours), d (days) and w (weeks).
+var lifetimeTag = regexp.MustCompile(`(?i)\s*\[(\d{1,4})\s*([hdw])\]\s*`)
+
+// splitLifetime removes the lifetime tag from a subject. Returns the subject
+// without the tag and the lifetime or 0, if the subject has no tag.
+func splitLifetime(subject string) (string, time.Duration) {
+	match := lifetimeTag.FindStringSubmatchIndex(subject)
+	if match == nil {
+		return subject, 0
+	}
+
+	n, _ := strconv.Atoi(subject[match[2]:match[3]])
+	unit := time.Hour
+	switch strings.ToLower(subject[match[4]:match[5]]) {
+	case "d":
+		unit = 24 * time.Hour
+	case "w":
+		unit = 7 * 24 * time.Hour
+	}
+
+	subject = strings.TrimSpace(subject[:match[0]] + " " + subject[match[1]:])
+	return subject, time.Duration(n) * unit
+}
+
+// setExpiry saves the time when an entry expires.
+func (p *pool) setExpiry(id int, expires time.Time) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", p.key("entry", strconv.Itoa(id)), "expires", formatTime(expires)); err != nil {
+		return xerrors.Errorf("can not save expiry of entry %d: %w", id, err)
+	}
+	return nil
+}
+
+// expiry returns the time when the entry expires because of its age or the
+// lifetime that was set by the sender. Returns the zero time, if the entry
+// does not expire.
+func (e entry) expiry() time.Time {
+	expires := e.Expires
+	if cfg.Retention.MaxAge > 0 {
+		if max := e.Date.Add(cfg.Retention.MaxAge); expires.IsZero() || max.Before(expires) {
+			expires = max
+		}
+	}
+	return expires
+}
+
+// expiredEntry is an entry that expires.
+type expiredEntry struct {
+	entry
+	expires time.Time
+}
+
+// expiringEntries returns all entries that expire. Entries that are over the
+// limit of max entries expire at now.
+func (p *pool) expiringEntries(now time.Time) ([]expiredEntry, error) {
+	entries, err := p.listEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	// The newest first
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+
+	var expiring []expiredEntry
+	for i, e := range entries {
+		expires := e.expiry()
+		if cfg.Retention.MaxEntries > 0 && i >= cfg.Retention.MaxEntries {
+			expires = now
+		}
+
+		if expires.IsZero() {
+			continue
+		}
+		expiring = append(expiring, expiredEntry{entry: e, expires: expires})
+	}
+
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].expires.Before(expiring[j].expires) })
+	return expiring, nil
+}
+
+// expire deletes or archives all expired entries and notifies the senders of
+// entries that expire soon. If dryRun is true, it only writes what would be
+// done. Errors of single entries are written to w.
+func (p *pool) expire(w io.Writer, now time.Time, dryRun bool) error {
+	expiring, err := p.expiringEntries(now)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range expiring {
+		if e.expires.After(now) {
+			if cfg.Retention.NotifyBefore == 0 || e.expires.Sub(now) > cfg.Retention.NotifyBefore {
+				continue
+			}
+
+			notified, err := p.expiryNotified(e.ID)
+			if err != nil {
+				return err
+			}
+
+			if notified {
+				continue
+			}
+
+			fmt.Fprintf(w, "entry %d: expires at %s, notify %s\n", e.ID, e.expires.Format("2006-01-02 15:04"), e.Mail)
+			if dryRun {
+				continue
+			}
+
+			if err := p.notifyExpiry(e.entry, e.expires); err != nil {
+				fmt.Fprintf(w, "entry %d: can not notify sender: %v\n", e.ID, err)
+			}
+			continue
+		}
+
+		fmt.Fprintf(w, "entry %d: expired at %s, %s\n", e.ID, e.expires.Format("2006-01-02 15:04"), cfg.Retention.Action)
+		if dryRun {
+			continue
+		}
+
+		if cfg.Retention.Action == "archive" {
+			if err := p.archiveEntry(e.entry); err != nil {
+				fmt.Fprintf(w, "entry %d: can not archive: %v\n", e.ID, err)
+				continue
+			}
+		}
+
+		if err := p.deleteFromID(e.ID); err != nil {
+			fmt.Fprintf(w, "entry %d: can not delete: %v\n", e.ID, err)
+		}
+	}
+	return nil
+}
+
+// expiryNotified returns true, if the sender of an entry was already notified
+// about the expiry.
+func (p *pool) expiryNotified(id int) (bool, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	notified, err := redis.Bool(conn.Do("HEXISTS", p.key("entry", strconv.Itoa(id)), "expirynotice"))
+	if err != nil {
+		return false, xerrors.Errorf("can not receive expiry notice of entry %d: %w", id, err)
+	}
+	return notified, nil
+}
+
+// expiryMailData is the data for the expiry mail templates.
+type expiryMailData struct {
+	Name      string
+	Subject   string
+	ImageLink string
+	Expires   string
+	Regards   string
+}
+
+// notifyExpiry sends a notice to the sender of an entry that the entry will
+// be deleted soon. The notice is saved after the mail was queued, so it is
+// tried again in the next run, if it can not be send.
+func (p *pool) notifyExpiry(e entry, expires time.Time) error {
+	to := recipient{name: e.From, address: e.Mail, lang: cfg.Language}
+	text, html, err := p.renderMail("mail_expiry", to.lang, expiryMailData{
+		Name:      e.From,
+		Subject:   e.Subject,
+		ImageLink: p.postURL(e.ID),
+		Expires:   formatDate(to.lang, expires),
+		Regards:   translate(to.lang, msgRegards, p.title),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := sendMail(p, to, translate(to.lang, msgExpirySubject, e.Subject), text, html); err != nil {
+		return err
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("HSET", p.key("entry", strconv.Itoa(e.ID)), "expirynotice", formatTime(time.Now())); err != nil {
+		return xerrors.Errorf("can not save expiry notice of entry %d: %w", e.ID, err)
+	}
+	return nil
+}
+
+// archiveEntry copies the image and moves the mail of an entry into the folder
+// archive/<id> of the store and writes the data of the entry into the file
+// entry.json.
+func (b *board) archiveEntry(e entry) error {
+	folder := path.Join("archive", strconv.Itoa(e.ID))
+
+	data, err := json.MarshalIndent(listedEntry{
+		ID:      e.ID,
+		Created: e.Date,
+		From:    e.From,
+		Mail:    e.Mail,
+		Subject: e.Subject,
+		Text:    e.Text,
+		Image:   fmt.Sprintf("%d%s", e.ID, e.Extension),
+	}, "", "  ")
+	if err != nil {
+		return xerrors.Errorf("can not encode entry: %w", err)
+	}
+
+	if err := b.store.write(path.Join(folder, "entry.json"), data); err != nil {
+		return xerrors.Errorf("can not write entry: %w", err)
+	}
+
+	// The blob is copied, because other entries can use it
+	image, err := b.readBlob(e.imageName())
+	if err != nil {
+		return xerrors.Errorf("can not read image: %w", err)
+	}
+
+	if err := b.store.write(path.Join(folder, fmt.Sprintf("%d%s", e.ID, e.Extension)), image); err != nil {
+		return xerrors.Errorf("can not write image to archive: %w", err)
+	}
+
+	mail := path.Join("success", strconv.Itoa(e.ID))
+	if err := b.store.rename(mail, path.Join(folder, "mail.eml")); err != nil && !os.IsNotExist(err) {
+		return xerrors.Errorf("can not move %s to archive: %w", mail, err)
+	}
+	return nil
+}
+
+// watchRetention deletes the expired entries. It never returns.
+func watchRetention(p *pool) {
+	ticker := time.NewTicker(cfg.Retention.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := p.expire(logWriter{}, time.Now(), false); err != nil {
+			log.Printf("Can not delete expired entries: %v", err)
+		}
+	}
+}
+
+// Expire deletes or archives all expired entries and notifies the senders of
+// entries that expire soon. If dryRun is true, nothing is changed.
+func Expire(w io.Writer, dryRun bool) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	return pool.expire(w, time.Now(), dryRun)
+}
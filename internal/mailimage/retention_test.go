@@ -0,0 +1,44 @@
+package mailimage
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestNotifyExpiryOnlyMarksSentNotices(t *testing.T) {
+	p := setupTest(t, "[duplicates]\naction = \"accept\"\n")
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board, noReply: true})
+	if err != nil {
+		t.Fatalf("insert returned error: %v", err)
+	}
+
+	e, err := p.getEntry(result.id)
+	if err != nil {
+		t.Fatalf("can not get entry: %v", err)
+	}
+
+	// An invalid sender lets the mail fail
+	from := p.from
+	p.from = "invalid"
+	if err := p.notifyExpiry(e, time.Now().Add(time.Hour)); err == nil {
+		t.Fatalf("notifyExpiry returned no error")
+	}
+	p.from = from
+
+	if notified, err := p.expiryNotified(e.ID); err != nil || notified {
+		t.Fatalf("entry is marked as notified after a failed mail (err: %v)", err)
+	}
+
+	if err := p.notifyExpiry(e, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("notifyExpiry returned error: %v", err)
+	}
+
+	if notified, err := p.expiryNotified(e.ID); err != nil || !notified {
+		t.Errorf("entry is not marked as notified (err: %v)", err)
+	}
+	if got := queuedMails(t, p); got != 1 {
+		t.Errorf("%d mails queued, expected the notice", got)
+	}
+}
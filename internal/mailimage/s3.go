@@ -0,0 +1,395 @@
+package mailimage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// s3Store saves the files in a bucket of a S3 compatible object storage. The
+// requests are signed with AWS signature version 4.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	urlExpiry time.Duration
+	client    *http.Client
+}
+
+// newS3Store creates a store for the files in folder below the prefix from
+// the config.
+func newS3Store(c storageConfig, folder string) (*s3Store, error) {
+	if c.Bucket == "" {
+		return nil, xerrors.New("storage.bucket is required for the s3 store")
+	}
+
+	region := c.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := c.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, xerrors.Errorf("invalid value for storage.endpoint: %s", endpoint)
+	}
+
+	accessKey, secretKey := c.AccessKey, c.SecretKey
+	if accessKey == "" {
+		accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+
+	prefix := strings.Trim(path.Join(c.Prefix, folder), "/")
+	if prefix == "." {
+		prefix = ""
+	}
+
+	return &s3Store{
+		endpoint:  u,
+		region:    region,
+		bucket:    c.Bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		pathStyle: c.PathStyle,
+		urlExpiry: c.URLExpiry,
+		client:    &http.Client{Timeout: time.Minute},
+	}, nil
+}
+
+// objectURL returns the url of an object. name is the key of the object
+// including the prefix. An empty name returns the url of the bucket.
+func (s *s3Store) objectURL(name string) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + name
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	}
+	u.RawPath = ""
+	return &u
+}
+
+// key returns the key of an object in the bucket.
+func (s *s3Store) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+// do sends a signed request to the store. The response is returned, if its
+// status code is 2xx. 404 is returned as an error for which os.IsNotExist
+// returns true.
+func (s *s3Store) do(method, name string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := s.objectURL(name)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, xerrors.Errorf("can not create request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, xerrors.Errorf("can not send request to s3: %w", err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: strings.ToLower(method), Path: name, Err: os.ErrNotExist}
+	}
+
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := xml.Unmarshal(data, &e); err != nil || e.Code == "" {
+		return nil, xerrors.Errorf("s3 %s %s: %s", method, name, resp.Status)
+	}
+	return nil, xerrors.Errorf("s3 %s %s: %s: %s", method, name, e.Code, e.Message)
+}
+
+// sign adds the authorization header to a request.
+func (s *s3Store) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		name := strings.ToLower(k)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+			values[name] = strings.TrimSpace(req.Header.Get(k))
+		}
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	signature := s.signature(req.Method, req.URL, headers.String(), signed, payloadHash, amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, s.scope(amzDate), signed, signature,
+	))
+}
+
+// scope returns the credential scope of a request.
+func (s *s3Store) scope(amzDate string) string {
+	return amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature calculates the signature of a request.
+func (s *s3Store) signature(method string, u *url.URL, headers, signed, payloadHash, amzDate string) string {
+	canonical := strings.Join([]string{
+		method,
+		s3Escape(u.Path, false),
+		s3Query(u.Query()),
+		headers,
+		signed,
+		payloadHash,
+	}, "\n")
+
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		s.scope(amzDate),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+
+	k := hmacSHA256([]byte("AWS4"+s.secretKey), amzDate[:8])
+	k = hmacSHA256(k, s.region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(k, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape encodes a string like AWS expects it. The slash is only encoded,
+// if slash is true.
+func s3Escape(s string, slash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !slash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters sorted by their name.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *s3Store) open(name string) (io.ReadCloser, error) {
+	resp, err := s.do("GET", s.key(name), nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) stat(name string) (blobInfo, error) {
+	resp, err := s.do("HEAD", s.key(name), nil, nil, nil)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	resp.Body.Close()
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return blobInfo{name: name, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *s3Store) write(name string, data []byte) error {
+	resp, err := s.do("PUT", s.key(name), nil, nil, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) put(local, name string) error {
+	data, err := ioutil.ReadFile(local)
+	if err != nil {
+		return xerrors.Errorf("can not read %s: %w", local, err)
+	}
+
+	if err := s.write(name, data); err != nil {
+		return err
+	}
+	return os.Remove(local)
+}
+
+// rename copies an object and deletes the original. S3 can not rename
+// objects.
+func (s *s3Store) rename(from, to string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", s3Escape("/"+s.bucket+"/"+s.key(from), false))
+
+	resp, err := s.do("PUT", s.key(to), nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// A copy can fail after the status code was send
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := xml.Unmarshal(data, &result); err == nil && result.XMLName.Local == "Error" {
+		return xerrors.Errorf("s3 can not copy %s to %s: %s", from, to, result.Code)
+	}
+
+	return s.remove(from)
+}
+
+func (s *s3Store) remove(name string) error {
+	resp, err := s.do("DELETE", s.key(name), nil, nil, nil)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) list(prefix string) ([]blobInfo, error) {
+	var infos []blobInfo
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", s.key(strings.TrimSuffix(prefix, "/")+"/"))
+
+	for {
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, xerrors.Errorf("can not list %s: %w", prefix, err)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, xerrors.Errorf("can not decode list of %s: %w", prefix, err)
+		}
+
+		for _, c := range result.Contents {
+			name := c.Key
+			if s.prefix != "" {
+				name = strings.TrimPrefix(name, s.prefix+"/")
+			}
+			infos = append(infos, blobInfo{name: name, size: c.Size, modTime: c.LastModified})
+		}
+
+		if !result.IsTruncated {
+			return infos, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// url returns a presigned url for a GET request of a file. contentType is send
+// by the store as header of the response.
+func (s *s3Store) url(name, contentType string) (string, error) {
+	return s.presign(name, contentType, time.Now()), nil
+}
+
+// presign returns the url from url for the time now.
+func (s *s3Store) presign(name, contentType string, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+
+	u := s.objectURL(s.key(name))
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(amzDate))
+	query.Set("X-Amz-Date", amzDate)
+	query.Set("X-Amz-Expires", strconv.Itoa(int(s.urlExpiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if contentType != "" {
+		query.Set("response-content-type", contentType)
+	}
+	u.RawQuery = s3Query(query)
+
+	signature := s.signature("GET", u, "host:"+u.Host+"\n", "host", "UNSIGNED-PAYLOAD", amzDate)
+	u.RawQuery += "&X-Amz-Signature=" + signature
+	return u.String()
+}
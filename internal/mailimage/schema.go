@@ -0,0 +1,270 @@
+package mailimage
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// The layout of the data in redis has a version that is saved in
+// key("schema"). Data without a version has the version 0.
+//
+// Version 1: The times of the entries are saved in RFC 3339 in UTC.
+// key("entries") is a sorted set with the creation time as score.
+//
+// Version 2: All images are in the blob store.
+
+// migration upgrades the data in redis from one version to the next. It can be
+// run more then once.
+type migration struct {
+	description string
+	run         func(p *pool, w io.Writer) error
+}
+
+// migrations are all migrations in their order. The migration at index i
+// upgrades from version i to version i+1.
+var migrations = []migration{
+	{"save times in RFC 3339 and sort the entries by creation time", migrateTimes},
+	{"move the images into the blob store", migrateBlobs},
+}
+
+// currentSchema returns the schema version that is used by this version of
+// mailimage.
+func currentSchema() int {
+	return len(migrations)
+}
+
+// legacyTimeFormat is the format of the times of the entries before version 1.
+// The times are in local time.
+const legacyTimeFormat = "2006-01-02 15:04:05"
+
+// timeFields are the fields of an entry that contain a time.
+var timeFields = []string{"created", "expires", "deleted", "expirynotice"}
+
+// formatTime returns a time in the format that is saved in redis.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// parseTime parses a time from redis. It is returned in local time.
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Local(), nil
+}
+
+// upgradeTimeFields converts the times in the fields of an entry from the
+// legacy format. Returns the names of the changed fields.
+func upgradeTimeFields(fields map[string]string) ([]string, error) {
+	var changed []string
+	for _, name := range timeFields {
+		value := fields[name]
+		if value == "" {
+			continue
+		}
+
+		if _, err := parseTime(value); err == nil {
+			continue
+		}
+
+		t, err := time.ParseInLocation(legacyTimeFormat, value, time.Local)
+		if err != nil {
+			return nil, xerrors.Errorf("can not parse %s %q: %w", name, value, err)
+		}
+		fields[name] = formatTime(t)
+		changed = append(changed, name)
+	}
+	return changed, nil
+}
+
+// initSchemaScript saves the current version for an empty database and
+// returns the saved version.
+//
+// KEYS: schema key, last id key, entries key
+// ARGV: current version
+var initSchemaScript = redis.NewScript(3, `
+if redis.call("EXISTS", KEYS[2]) == 0 and redis.call("EXISTS", KEYS[3]) == 0 then
+	redis.call("SETNX", KEYS[1], ARGV[1])
+end
+return redis.call("GET", KEYS[1])
+`)
+
+// schemaVersion returns the version of the data in redis. An empty database
+// gets the current version.
+func (p *pool) schemaVersion() (int, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	version, err := redis.Int(initSchemaScript.Do(conn, p.key("schema"), p.key("last_id"), p.key("entries"), currentSchema()))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, xerrors.Errorf("can not receive schema version: %w", err)
+	}
+	return version, nil
+}
+
+// storedSchemaVersion returns the version of the data in redis like
+// schemaVersion, but it does not save the version of an empty database.
+func (p *pool) storedSchemaVersion() (int, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	version, err := redis.Int(conn.Do("GET", p.key("schema")))
+	if err == nil {
+		return version, nil
+	}
+	if err != redis.ErrNil {
+		return 0, xerrors.Errorf("can not receive schema version: %w", err)
+	}
+
+	exists, err := redis.Bool(conn.Do("EXISTS", p.key("last_id"), p.key("entries")))
+	if err != nil {
+		return 0, xerrors.Errorf("can not check for data: %w", err)
+	}
+	if exists {
+		return 0, nil
+	}
+	return currentSchema(), nil
+}
+
+// checkSchema returns an error, if the data in redis does not have the
+// current version.
+func (p *pool) checkSchema() error {
+	version, err := p.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > currentSchema() {
+		return xerrors.Errorf("the data has the schema version %d, that is newer than this version of mailimage (%d)", version, currentSchema())
+	}
+
+	if version < currentSchema() {
+		return xerrors.Errorf("the data has the schema version %d, but %d is required. Run `mailimage migrate`", version, currentSchema())
+	}
+	return nil
+}
+
+// migrateTimes converts the times of all entries into RFC 3339 and converts
+// key("entries") into a sorted set.
+func migrateTimes(p *pool, w io.Writer) error {
+	ids, err := p.entryKeys("")
+	if err != nil {
+		return err
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	created := make(map[int]time.Time)
+	for _, id := range sortedIDs(ids) {
+		fields, err := redis.StringMap(conn.Do("HGETALL", p.key("entry", strconv.Itoa(id))))
+		if err != nil {
+			return xerrors.Errorf("can not receive entry %d: %w", id, err)
+		}
+
+		changed, err := upgradeTimeFields(fields)
+		if err != nil {
+			return xerrors.Errorf("entry %d: %w", id, err)
+		}
+
+		if len(changed) > 0 {
+			args := []interface{}{p.key("entry", strconv.Itoa(id))}
+			for _, name := range changed {
+				args = append(args, name, fields[name])
+			}
+			if _, err := conn.Do("HMSET", args...); err != nil {
+				return xerrors.Errorf("can not save entry %d: %w", id, err)
+			}
+			fmt.Fprintf(w, "entry %d: converted %d times\n", id, len(changed))
+		}
+
+		if t, err := parseTime(fields["created"]); err == nil {
+			created[id] = t
+		}
+	}
+
+	kind, err := redis.String(conn.Do("TYPE", p.key("entries")))
+	if err != nil {
+		return xerrors.Errorf("can not receive type of entries: %w", err)
+	}
+
+	if kind != "set" {
+		return nil
+	}
+
+	members, err := redis.Ints(conn.Do("SMEMBERS", p.key("entries")))
+	if err != nil {
+		return xerrors.Errorf("can not receive ids: %w", err)
+	}
+
+	// Entries without a creation time can not be sorted. They are not listed
+	// anymore and reported by fsck.
+	var sorted int
+	conn.Send("MULTI")
+	conn.Send("DEL", p.key("entries"))
+	for _, id := range members {
+		t, ok := created[id]
+		if !ok {
+			fmt.Fprintf(w, "entry %d: no creation time, removed from the list\n", id)
+			continue
+		}
+		conn.Send("ZADD", p.key("entries"), t.Unix(), id)
+		sorted++
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return xerrors.Errorf("can not save sorted entries: %w", err)
+	}
+
+	fmt.Fprintf(w, "sorted %d entries by creation time\n", sorted)
+	return nil
+}
+
+// Migrate upgrades the data in redis to the current schema version. A line
+// for each migration is written to w.
+func Migrate(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	version, err := pool.schemaVersion()
+	if err != nil {
+		return err
+	}
+
+	if version > currentSchema() {
+		return xerrors.Errorf("the data has the schema version %d, that is newer than this version of mailimage (%d)", version, currentSchema())
+	}
+
+	if version == currentSchema() {
+		fmt.Fprintf(w, "Schema version %d is up to date\n", version)
+		return nil
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+
+	for ; version < currentSchema(); version++ {
+		m := migrations[version]
+		fmt.Fprintf(w, "Migration %d: %s\n", version+1, m.description)
+		if err := m.run(pool, w); err != nil {
+			return xerrors.Errorf("migration %d failed: %w", version+1, err)
+		}
+
+		if _, err := conn.Do("SET", pool.key("schema"), version+1); err != nil {
+			return xerrors.Errorf("can not save schema version: %w", err)
+		}
+	}
+
+	fmt.Fprintf(w, "Schema version %d is up to date\n", version)
+	return nil
+}
@@ -0,0 +1,65 @@
+package mailimage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func TestInsertChecksSchema(t *testing.T) {
+	p := setupTest(t, "")
+
+	conn := p.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", p.key("schema"), 1); err != nil {
+		t.Fatalf("can not set schema version: %v", err)
+	}
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board, noReply: true})
+	if err == nil {
+		t.Fatalf("insert returned no error")
+	}
+	if result.folder != "error" {
+		t.Errorf("mail is in folder %q, expected error", result.folder)
+	}
+
+	exists, err := redis.Bool(conn.Do("EXISTS", p.key("entry", "1")))
+	if err != nil {
+		t.Fatalf("can not check entry: %v", err)
+	}
+	if exists {
+		t.Errorf("entry was saved with an old schema")
+	}
+}
+
+func TestMigrateTimesWithoutCreated(t *testing.T) {
+	p := setupTest(t, "")
+
+	conn := p.Get()
+	defer conn.Close()
+	conn.Send("SADD", p.key("entries"), 1, 2)
+	conn.Send("HSET", p.key("entry", "1"), "created", "2019-05-19 22:17:01")
+	conn.Send("HSET", p.key("entry", "2"), "title", "Kohl")
+	if _, err := conn.Do(""); err != nil {
+		t.Fatalf("can not save entries: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := migrateTimes(p, &out); err != nil {
+		t.Fatalf("migrateTimes returned error: %v", err)
+	}
+
+	ids, err := redis.Ints(conn.Do("ZRANGE", p.key("entries"), 0, -1))
+	if err != nil {
+		t.Fatalf("can not receive entries: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Errorf("entries are %v, expected [1]", ids)
+	}
+
+	if !strings.Contains(out.String(), "entry 2: no creation time") {
+		t.Errorf("entry without creation time is not reported:\n%s", out.String())
+	}
+}
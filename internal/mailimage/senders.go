@@ -0,0 +1,300 @@
+package mailimage
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// senderRules decides which mail addresses are allowed to post images.
+//
+// An address is rejected, if it is in Block or matches one of the
+// BlockPatterns. If there is at least one entry in Allow or AllowDomains, only
+// addresses in Allow or from a domain in AllowDomains are accepted. Patterns
+// use the syntax of path.Match, for example "*@spam.example".
+type senderRules struct {
+	Allow         []string `toml:"allow"`
+	AllowDomains  []string `toml:"allow_domains"`
+	Block         []string `toml:"block"`
+	BlockPatterns []string `toml:"block_patterns"`
+
+	// Exempt are addresses that are not limited by the post limits.
+	Exempt []string `toml:"exempt"`
+}
+
+// senderLists are the names of the rule lists how they are saved in redis.
+var senderLists = [...]string{"allow", "allow_domains", "block", "block_patterns", "exempt"}
+
+// list returns a pointer to the rule list with the given name.
+func (r *senderRules) list(name string) *[]string {
+	switch name {
+	case "allow":
+		return &r.Allow
+	case "allow_domains":
+		return &r.AllowDomains
+	case "block":
+		return &r.Block
+	case "block_patterns":
+		return &r.BlockPatterns
+	case "exempt":
+		return &r.Exempt
+	}
+	return nil
+}
+
+// merge returns new rules that contain the rules from r and o.
+func (r senderRules) merge(o senderRules) senderRules {
+	var m senderRules
+	for _, name := range senderLists {
+		*m.list(name) = append(append([]string{}, *r.list(name)...), *o.list(name)...)
+	}
+	return m
+}
+
+// allowed returns true, if the address is allowed to post images.
+func (r senderRules) allowed(address string) bool {
+	address = strings.ToLower(strings.TrimSpace(address))
+	domain := address[strings.LastIndex(address, "@")+1:]
+
+	for _, blocked := range r.Block {
+		if strings.ToLower(blocked) == address {
+			return false
+		}
+	}
+
+	for _, pattern := range r.BlockPatterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), address); ok {
+			return false
+		}
+	}
+
+	if len(r.Allow) == 0 && len(r.AllowDomains) == 0 {
+		return true
+	}
+
+	for _, allowed := range r.Allow {
+		if strings.ToLower(allowed) == address {
+			return true
+		}
+	}
+
+	for _, allowed := range r.AllowDomains {
+		if strings.ToLower(strings.TrimPrefix(allowed, "@")) == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// senderRejectError returns the error that is send to a rejected sender.
+func senderRejectError() error {
+	if cfg.Senders.RejectMessage != "" {
+		return xerrors.New(cfg.Senders.RejectMessage)
+	}
+	return errSenderRejected
+}
+
+// senderRules returns the rules from the config merged with the rules that are
+// saved in redis.
+func (p *pool) senderRules() (senderRules, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	var rules senderRules
+	for _, name := range senderLists {
+		values, err := redis.Strings(conn.Do("SMEMBERS", p.key("senders", name)))
+		if err != nil {
+			return senderRules{}, xerrors.Errorf("can not receive sender rules %s: %w", name, err)
+		}
+		*rules.list(name) = values
+	}
+	return cfg.Senders.senderRules.merge(rules), nil
+}
+
+// addSenderRule saves a rule to one of the sender lists.
+func (p *pool) addSenderRule(list, rule string) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SADD", p.key("senders", list), strings.ToLower(rule)); err != nil {
+		return xerrors.Errorf("can not save sender rule: %w", err)
+	}
+	return nil
+}
+
+// senderRuleLists returns the lists that can contain a rule how it is written
+// on the command line and the rule how it is saved. A rule starting with an @
+// is a domain, a rule with one of the characters *?[ is a pattern.
+func senderRuleLists(rule string) ([]string, string) {
+	rule = strings.ToLower(rule)
+	switch {
+	case strings.HasPrefix(rule, "@"):
+		return []string{"allow_domains"}, rule[1:]
+	case strings.ContainsAny(rule, "*?["):
+		return []string{"block_patterns"}, rule
+	}
+	return []string{"allow", "block", "exempt"}, rule
+}
+
+// senderRuleIn returns the names of the lists in redis that contain the rule
+// exactly as saved.
+func (p *pool) senderRuleIn(lists []string, rule string) ([]string, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	var found []string
+	for _, name := range lists {
+		ok, err := redis.Bool(conn.Do("SISMEMBER", p.key("senders", name), rule))
+		if err != nil {
+			return nil, xerrors.Errorf("can not receive sender rule: %w", err)
+		}
+		if ok {
+			found = append(found, name)
+		}
+	}
+	return found, nil
+}
+
+// removeSenderRule removes a rule from one sender list.
+func (p *pool) removeSenderRule(list, rule string) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SREM", p.key("senders", list), rule); err != nil {
+		return xerrors.Errorf("can not remove sender rule: %w", err)
+	}
+	return nil
+}
+
+// SenderAllow allows addresses to post images. A rule starting with an @ allows
+// a whole domain.
+func SenderAllow(rules ...string) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	for _, rule := range rules {
+		list := "allow"
+		if strings.HasPrefix(rule, "@") {
+			list = "allow_domains"
+			rule = rule[1:]
+		}
+
+		if err := pool.addSenderRule(list, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SenderBlock blocks addresses from posting images. A rule containing one of
+// the characters *?[ is used as pattern.
+func SenderBlock(rules ...string) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	for _, rule := range rules {
+		list := "block"
+		if strings.ContainsAny(rule, "*?[") {
+			if _, err := path.Match(rule, ""); err != nil {
+				return xerrors.Errorf("invalid pattern %s: %w", rule, err)
+			}
+			list = "block_patterns"
+		}
+
+		if err := pool.addSenderRule(list, rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SenderExempt excludes addresses from the post limits.
+func SenderExempt(addresses ...string) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	for _, address := range addresses {
+		if err := pool.addSenderRule("exempt", address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SenderRemove removes rules that where added with SenderAllow, SenderBlock or
+// SenderExempt and writes the changed lists to w. A rule is only removed from
+// the lists where it was added in the same form, so "@example.com" does not
+// remove "example.com" from another list. If list is not empty, only this
+// list is changed. A rule that is in more than one list needs a list, because
+// removing it from all lists could allow a blocked sender.
+func SenderRemove(w io.Writer, list string, rules ...string) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	if list != "" && (&senderRules{}).list(list) == nil {
+		return xerrors.Errorf("unknown sender list %s, use one of %s", list, strings.Join(senderLists[:], ", "))
+	}
+
+	for _, rule := range rules {
+		lists, stored := senderRuleLists(rule)
+		if list != "" {
+			lists, stored = []string{list}, strings.ToLower(strings.TrimPrefix(rule, "@"))
+		}
+
+		found, err := pool.senderRuleIn(lists, stored)
+		if err != nil {
+			return err
+		}
+
+		if len(found) == 0 {
+			return xerrors.Errorf("rule %s does not exist", rule)
+		}
+		if len(found) > 1 {
+			return xerrors.Errorf("rule %s is in the lists %s, select one with --list", rule, strings.Join(found, " and "))
+		}
+
+		if err := pool.removeSenderRule(found[0], stored); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "removed %s from %s\n", rule, found[0])
+	}
+	return nil
+}
+
+// SenderList writes all sender rules to w. Rules from the config file are
+// marked.
+func SenderList(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	rules, err := pool.senderRules()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range senderLists {
+		fromConfig := len(*cfg.Senders.senderRules.list(name))
+		for i, rule := range *rules.list(name) {
+			source := ""
+			if i < fromConfig {
+				source = " (config)"
+			}
+			fmt.Fprintf(w, "%-15s %s%s\n", name, rule, source)
+		}
+	}
+	return nil
+}
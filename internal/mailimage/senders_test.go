@@ -0,0 +1,68 @@
+package mailimage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// senderListsOf returns the lists in redis that contain the rule.
+func senderListsOf(t testing.TB, p *pool, rule string) []string {
+	t.Helper()
+
+	lists, err := p.senderRuleIn(senderLists[:], rule)
+	if err != nil {
+		t.Fatalf("senderRuleIn returned error: %v", err)
+	}
+	return lists
+}
+
+func TestSenderRemoveExactRule(t *testing.T) {
+	p := setupTest(t, "")
+
+	for _, rule := range []struct{ list, value string }{
+		{"allow_domains", "example.com"},
+		{"block", "example.com"},
+	} {
+		if err := p.addSenderRule(rule.list, rule.value); err != nil {
+			t.Fatalf("addSenderRule returned error: %v", err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := SenderRemove(&out, "", "@example.com"); err != nil {
+		t.Fatalf("SenderRemove returned error: %v", err)
+	}
+
+	if got := senderListsOf(t, p, "example.com"); len(got) != 1 || got[0] != "block" {
+		t.Errorf("rule is in the lists %v, expected only block", got)
+	}
+	if !strings.Contains(out.String(), "removed @example.com from allow_domains") {
+		t.Errorf("changed list is not reported: %q", out.String())
+	}
+}
+
+func TestSenderRemoveNeedsList(t *testing.T) {
+	p := setupTest(t, "")
+
+	for _, list := range []string{"allow", "block"} {
+		if err := p.addSenderRule(list, "alice@example.com"); err != nil {
+			t.Fatalf("addSenderRule returned error: %v", err)
+		}
+	}
+
+	if err := SenderRemove(ioutil.Discard, "", "alice@example.com"); err == nil {
+		t.Fatalf("SenderRemove of a rule in two lists returned no error")
+	}
+	if got := senderListsOf(t, p, "alice@example.com"); len(got) != 2 {
+		t.Fatalf("rule is in the lists %v, expected allow and block", got)
+	}
+
+	if err := SenderRemove(ioutil.Discard, "allow", "alice@example.com"); err != nil {
+		t.Fatalf("SenderRemove returned error: %v", err)
+	}
+	if got := senderListsOf(t, p, "alice@example.com"); len(got) != 1 || got[0] != "block" {
+		t.Errorf("rule is in the lists %v, expected only block", got)
+	}
+}
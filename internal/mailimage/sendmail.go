@@ -3,83 +3,166 @@ package mailimage
 import (
 	"bytes"
 	"fmt"
-	"os"
-	"text/template"
+	"io/ioutil"
+	"log"
+	netmail "net/mail"
+	"strings"
 
 	"golang.org/x/xerrors"
 	"gopkg.in/mail.v2"
 )
 
-var (
-	mailErrorTmpl   = template.Must(template.New("mailError").Parse(sendErrorTemplate))
-	mailSuccessTmpl = template.Must(template.New("mailSuccess").Parse(sendSuccessTemplate))
-)
+// inlineImage is an image that is embedded into the html part of a mail. It
+// can be referenced with cid:<name>.
+type inlineImage struct {
+	name string
+	data []byte
+}
+
+// sendMail puts an email to an receiver into the mail queue. It is delivered
+// with the mailer from the config.
+//
+// No mail is send, if the incoming mail was send automatically or if too many
+// mails where send to the receiver.
+func sendMail(redis *pool, to recipient, subject, text, html string, images ...inlineImage) error {
+	if to.automated {
+		log.Printf("Do not respond to automated mail from %s", to.address)
+		return nil
+	}
+
+	if to.noReply {
+		return nil
+	}
 
-// sendMail sends an email to an receiver.
-// If the environment varialbe DEBUG is set, prints the mail to stdout
-func sendMail(to string, subject string, text string) error {
 	m := mail.NewMessage()
-	m.SetHeader("From", fromAdress)
-	m.SetHeader("To", to)
+	m.SetHeader("From", redis.from)
+	m.SetHeader("To", to.address)
 	m.SetHeader("Subject", subject)
+	m.SetHeader("Auto-Submitted", "auto-replied")
+	if to.messageID != "" {
+		m.SetHeader("In-Reply-To", to.messageID)
+		m.SetHeader("References", strings.TrimSpace(to.references+" "+to.messageID))
+	}
 	m.SetBody("text/plain", text)
+	m.AddAlternative("text/html", html)
+	for _, image := range images {
+		m.EmbedReader(image.name, bytes.NewReader(image.data))
+	}
 
-	if os.Getenv("DEBUG") != "" {
-		if _, err := m.WriteTo(os.Stdout); err != nil {
-			return xerrors.Errorf("can not write mail to stdout: %w", err)
-		}
-		return nil
+	from, err := netmail.ParseAddress(redis.from)
+	if err != nil {
+		return xerrors.Errorf("invalid from address %s: %w", redis.from, err)
 	}
 
-	d := mail.Dialer{Host: smptHost, Port: smptPort, StartTLSPolicy: mail.NoStartTLS}
-	if err := d.DialAndSend(m); err != nil {
-		return xerrors.Errorf("can not send mail: %w", err)
+	return redis.enqueueMail(from.Address, []string{to.address}, subject, m)
+}
+
+// errorMailData is the data for the error mail templates.
+type errorMailData struct {
+	Name    string
+	Errors  []string
+	Regards string
+}
+
+// successMailData is the data for the success mail templates.
+type successMailData struct {
+	Name       string
+	ImageLink  string
+	RemoveLink string
+	Regards    string
+
+	// Thumbnail is the content id of the embedded thumbnail. It is empty, if
+	// there is no thumbnail.
+	Thumbnail string
+}
+
+// renderMail renders the text and the html part of a mail template of the
+// board.
+func (b *board) renderMail(name, lang string, data interface{}) (string, string, error) {
+	var text, html bytes.Buffer
+	if err := b.getTemplates().mail(name, lang).Execute(&text, data); err != nil {
+		return "", "", xerrors.Errorf("can not execute template %s: %w", name, err)
 	}
-	return nil
+
+	if err := b.getTemplates().htmlMail(name, lang).Execute(&html, data); err != nil {
+		return "", "", xerrors.Errorf("can not execute html template %s: %w", name, err)
+	}
+	return text.String(), html.String(), nil
 }
 
 // respondError response to an incomming mail with an error message.
-func respondError(name, address, subject string, errs []error) error {
-	var text bytes.Buffer
-	err := mailErrorTmpl.Execute(
-		&text,
-		struct {
-			Name    string
-			Errors  []error
-			Regards string
-		}{
-			name,
-			errs,
-			responseRegards,
-		},
-	)
+//
+// Error mails are limited by replies.rate_limit, so a sender with a spoofed
+// address can not flood someone else. Success mails and notices are always
+// send, because they contain the delete link.
+func respondError(redis *pool, to recipient, subject string, errs []error) error {
+	if !to.automated && !to.noReply {
+		allowed, err := redis.allowReply(to.address)
+		if err != nil {
+			return err
+		}
+
+		if !allowed {
+			log.Printf("Do not respond to %s, too many responses", to.address)
+			return nil
+		}
+	}
+
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = localizeError(err, to.lang)
+	}
+
+	text, html, err := redis.renderMail("mail_error", to.lang, errorMailData{
+		Name:    to.name,
+		Errors:  messages,
+		Regards: translate(to.lang, msgRegards, redis.title),
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendMail(redis, to, "Re: "+subject, text, html)
+}
+
+// respondSuccess response to an incomming mail with an success message. The
+// thumbnail of the image is embedded into the html part.
+func respondSuccess(redis *pool, to recipient, subject string, blob string, token string) error {
+	data := successMailData{
+		Name:       to.name,
+		ImageLink:  redis.deleteRedirectURL,
+		RemoveLink: fmt.Sprintf("%s/delete/%s", redis.baseURL, token),
+		Regards:    translate(to.lang, msgRegards, redis.title),
+	}
+
+	var images []inlineImage
+	thumbnail, err := redis.readThumbnail(blob)
 	if err != nil {
-		return xerrors.Errorf("can not render error template: %w", err)
+		log.Printf("Can not embed thumbnail into mail: %v", err)
+	} else {
+		images = append(images, inlineImage{name: "thumbnail.jpg", data: thumbnail})
+		data.Thumbnail = "thumbnail.jpg"
 	}
 
-	return sendMail(address, "Re: "+subject, text.String())
+	text, html, err := redis.renderMail("mail_success", to.lang, data)
+	if err != nil {
+		return err
+	}
+
+	return sendMail(redis, to, "Re: "+subject, text, html, images...)
 }
 
-// respondSuccess response to an incomming mail with an success message.
-func respondSuccess(name, address, subject, token string) error {
-	var text bytes.Buffer
-	err := mailSuccessTmpl.Execute(
-		&text,
-		struct {
-			Name       string
-			ImageLink  string
-			RemoveLink string
-			Regards    string
-		}{
-			name,
-			deleteRedirectURL,
-			fmt.Sprintf("%s/delete/%s", baseURL, token),
-			responseRegards,
-		},
-	)
+// readThumbnail returns the content of the thumbnail of a blob.
+func (b *board) readThumbnail(blob string) ([]byte, error) {
+	f, err := b.openThumbnail(blob)
 	if err != nil {
-		return xerrors.Errorf("can not execute template: %w", err)
+		return nil, err
 	}
+	defer f.Close()
 
-	return sendMail(address, "Re: "+subject, text.String())
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, xerrors.Errorf("can not read thumbnail: %w", err)
+	}
+	return content, nil
 }
@@ -0,0 +1,212 @@
+package mailimage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// blobStore saves the images, thumbnails and mails. Names are slash separated
+// paths relative to the root of the store like "blobs/ab/cd/<hash>" or
+// "success/12".
+//
+// Files that do not exist are reported with an error for which os.IsNotExist
+// returns true.
+type blobStore interface {
+	open(name string) (io.ReadCloser, error)
+	stat(name string) (blobInfo, error)
+	write(name string, data []byte) error
+
+	// put moves a local file into the store.
+	put(local, name string) error
+
+	rename(from, to string) error
+
+	// remove deletes a file. It does not fail, if the file does not exist.
+	remove(name string) error
+
+	// list returns all files below the folder prefix.
+	list(prefix string) ([]blobInfo, error)
+
+	// url returns a link where clients can download a file directly. It
+	// returns an empty string, if the store does not support links.
+	url(name, contentType string) (string, error)
+}
+
+// blobInfo describes a file in the store.
+type blobInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// storageConfig contains the settings where the files are saved.
+type storageConfig struct {
+	// Type selects the store. Supported are "file" and "s3". The file store
+	// saves everything in the folder from the environment variable
+	// MAILIMAGE_PATH.
+	Type string `toml:"type"`
+
+	// Settings for the s3 store. Endpoint defaults to the endpoint of AWS for
+	// the region. The credentials default to the environment variables
+	// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Prefix is put before all
+	// names. PathStyle uses urls like <endpoint>/<bucket>/<name> instead of
+	// <bucket>.<endpoint>/<name>.
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	Prefix    string `toml:"prefix"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	PathStyle bool   `toml:"path_style"`
+
+	// Redirect lets the webserver redirect requests for images and
+	// thumbnails to a presigned url of the store instead of sending the
+	// file itself. The url is valid for URLExpiry.
+	Redirect  bool          `toml:"redirect"`
+	URLExpiry time.Duration `toml:"url_expiry"`
+}
+
+// newBlobStore creates the store that is selected in the config for the
+// files in folder.
+func newBlobStore(c storageConfig, folder string) (blobStore, error) {
+	switch c.Type {
+	case "file":
+		return fileStore{root: filepath.Join(mailimagePath(), filepath.FromSlash(folder))}, nil
+
+	case "s3":
+		return newS3Store(c, folder)
+	}
+	return nil, xerrors.Errorf("invalid value for storage.type: %s", c.Type)
+}
+
+// fileStore saves the files in a folder below mailimagePath.
+type fileStore struct {
+	root string
+}
+
+// path returns the path of a file on disk.
+func (s fileStore) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s fileStore) open(name string) (io.ReadCloser, error) {
+	return os.Open(s.path(name))
+}
+
+func (s fileStore) stat(name string) (blobInfo, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	return blobInfo{name: name, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (s fileStore) write(name string, data []byte) error {
+	return writeFileAtomic(s.path(name), data)
+}
+
+func (s fileStore) put(local, name string) error {
+	return s.move(local, s.path(name))
+}
+
+func (s fileStore) rename(from, to string) error {
+	return s.move(s.path(from), s.path(to))
+}
+
+// move renames a file and creates the target folder.
+func (fileStore) move(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return xerrors.Errorf("can not create folder %s: %w", filepath.Dir(to), err)
+	}
+	return os.Rename(from, to)
+}
+
+func (s fileStore) remove(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s fileStore) list(prefix string) ([]blobInfo, error) {
+	var infos []blobInfo
+	err := filepath.Walk(s.path(prefix), func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		// Temporary files are written by writeFileAtomic
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".tmp-") {
+			return nil
+		}
+
+		name, err := filepath.Rel(s.root, file)
+		if err != nil {
+			return err
+		}
+		infos = append(infos, blobInfo{name: filepath.ToSlash(name), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, xerrors.Errorf("can not read folder %s: %w", prefix, err)
+	}
+	return infos, nil
+}
+
+func (fileStore) url(name, contentType string) (string, error) {
+	return "", nil
+}
+
+// writeFileAtomic writes a file by writing a temporary file in the same folder
+// and renaming it. So no other process sees a partial file.
+func writeFileAtomic(name string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		return xerrors.Errorf("can not create folder: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return xerrors.Errorf("can not create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return xerrors.Errorf("can not write temporary file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return xerrors.Errorf("can not write temporary file: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return xerrors.Errorf("can not change file mode: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), name)
+}
+
+// readBlob returns the content of a file in the store of the board.
+func (b *board) readBlob(name string) ([]byte, error) {
+	f, err := b.store.open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, xerrors.Errorf("can not read %s: %w", name, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,188 @@
+package mailimage
+
+import (
+	"embed"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/template"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// embeddedTemplates are the default templates. Each of them can be replaced by
+// a file with the same name in the template dir from the config.
+//
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templateSet contains all parsed templates.
+type templateSet struct {
+	index     *htmltemplate.Template
+	post      *htmltemplate.Template
+	errorPage *htmltemplate.Template
+	deleted   *htmltemplate.Template
+	trash     *htmltemplate.Template
+
+	// mails and htmlMails contain the text and html parts of the mail
+	// templates with the name and the language as key, for example
+	// "mail_error.de".
+	mails     map[string]*template.Template
+	htmlMails map[string]*htmltemplate.Template
+}
+
+// mail returns the text part of a mail template in the given language.
+func (t *templateSet) mail(name, lang string) *template.Template {
+	return t.mails[name+"."+lang]
+}
+
+// htmlMail returns the html part of a mail template in the given language.
+func (t *templateSet) htmlMail(name, lang string) *htmltemplate.Template {
+	return t.htmlMails[name+"."+lang]
+}
+
+// getTemplates returns the current templates of the board.
+func (b *board) getTemplates() *templateSet {
+	b.templatesMu.RLock()
+	defer b.templatesMu.RUnlock()
+	return b.templates
+}
+
+// loadTemplates parses all templates of the board and replaces the current
+// ones. If one template can not be parsed, the current templates are kept.
+func (b *board) loadTemplates() error {
+	var t templateSet
+
+	html := map[string]**htmltemplate.Template{
+		"index.html":   &t.index,
+		"post.html":    &t.post,
+		"error.html":   &t.errorPage,
+		"deleted.html": &t.deleted,
+		"trash.html":   &t.trash,
+	}
+	for name, tmpl := range html {
+		content, err := b.readTemplate(name)
+		if err != nil {
+			return err
+		}
+
+		*tmpl, err = htmltemplate.New(name).Parse(content)
+		if err != nil {
+			return xerrors.Errorf("can not parse template %s: %w", name, err)
+		}
+	}
+
+	t.mails = make(map[string]*template.Template)
+	t.htmlMails = make(map[string]*htmltemplate.Template)
+	for _, name := range []string{"mail_error", "mail_success", "mail_expiry"} {
+		for _, lang := range languageCodes {
+			fileName := name + "." + lang + ".txt"
+			content, err := b.readTemplate(fileName)
+			if err != nil {
+				return err
+			}
+
+			t.mails[name+"."+lang], err = template.New(fileName).Parse(content)
+			if err != nil {
+				return xerrors.Errorf("can not parse template %s: %w", fileName, err)
+			}
+
+			fileName = name + "." + lang + ".html"
+			content, err = b.readTemplate(fileName)
+			if err != nil {
+				return err
+			}
+
+			t.htmlMails[name+"."+lang], err = htmltemplate.New(fileName).Parse(content)
+			if err != nil {
+				return xerrors.Errorf("can not parse template %s: %w", fileName, err)
+			}
+		}
+	}
+
+	b.templatesMu.Lock()
+	b.templates = &t
+	b.templatesMu.Unlock()
+	return nil
+}
+
+// readTemplate reads a template from the template dir of the board. If the
+// file does not exist, the embedded template is used.
+func (b *board) readTemplate(name string) (string, error) {
+	if b.templateDir != "" {
+		content, err := ioutil.ReadFile(filepath.Join(b.templateDir, name))
+		if err == nil {
+			return string(content), nil
+		}
+
+		if !os.IsNotExist(err) {
+			return "", xerrors.Errorf("can not read template %s: %w", name, err)
+		}
+	}
+
+	content, err := embeddedTemplates.ReadFile("templates/" + name)
+	if err != nil {
+		return "", xerrors.Errorf("can not read embedded template %s: %w", name, err)
+	}
+	return string(content), nil
+}
+
+// watchTemplates reloads the templates of the board when the process receives
+// SIGHUP or when a file in the template dir is changed. It never returns.
+func (b *board) watchTemplates() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	lastChange := b.templateDirModTime()
+	for {
+		select {
+		case <-hup:
+
+		case <-ticker.C:
+			change := b.templateDirModTime()
+			if change.Equal(lastChange) {
+				continue
+			}
+			lastChange = change
+		}
+
+		if err := b.loadTemplates(); err != nil {
+			log.Printf("Can not reload templates of board %s: %v", b, err)
+			continue
+		}
+		log.Printf("Templates of board %s reloaded", b)
+	}
+}
+
+// templateDirModTime returns the latest modification time of the template dir
+// of the board and all files in it.
+func (b *board) templateDirModTime() time.Time {
+	var latest time.Time
+	if b.templateDir == "" {
+		return latest
+	}
+
+	if info, err := os.Stat(b.templateDir); err == nil {
+		latest = info.ModTime()
+	}
+
+	infos, err := ioutil.ReadDir(b.templateDir)
+	if err != nil {
+		return latest
+	}
+
+	for _, info := range infos {
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
@@ -0,0 +1,300 @@
+package mailimage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/xerrors"
+)
+
+// trashPurgeInterval is the time between two runs of the trash purge in serve.
+const trashPurgeInterval = time.Hour
+
+// trashConfig contains the settings for deleted entries.
+type trashConfig struct {
+	// Keep is the time that deleted entries stay in the trash and can be
+	// restored. 0 means that entries are deleted immediately.
+	Keep time.Duration `toml:"keep"`
+}
+
+// trashFiles returns the names of the files of an entry that are moved into
+// the trash and their names in the trash folder. The image stays in the blob
+// store, because other entries can use it.
+func trashFiles(id int) map[string]string {
+	name := strconv.Itoa(id)
+	return map[string]string{
+		path.Join("success", name): path.Join("trash", "success", name),
+	}
+}
+
+// moveFiles renames each key of files to its value in the store. Files that do
+// not exist are ignored.
+func (b *board) moveFiles(files map[string]string) error {
+	for from, to := range files {
+		if err := b.store.rename(from, to); err != nil && !os.IsNotExist(err) {
+			return xerrors.Errorf("can not move %s to %s: %w", from, to, err)
+		}
+	}
+	return nil
+}
+
+// trashEntry moves an entry into the trash. It is hidden from the website and
+// can be restored until it is purged. If the trash is disabled, the entry is
+// deleted immediately.
+func (p *pool) trashEntry(id int) error {
+	if cfg.Trash.Keep == 0 {
+		return p.deleteFromID(id)
+	}
+
+	if _, err := p.getExtension(id); err != nil {
+		return err
+	}
+
+	conn := p.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "deletetoken"))
+	if err != nil && err != redis.ErrNil {
+		return xerrors.Errorf("can not receive delete token of entry %d: %w", id, err)
+	}
+
+	// Move the files first, so the entry is not in the trash while its mail
+	// is still in the success folder.
+	if err := p.moveFiles(trashFiles(id)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	conn.Send("MULTI")
+	conn.Send("ZREM", p.key("entries"), id)
+	conn.Send("HSET", p.key("entry", strconv.Itoa(id)), "deleted", formatTime(now))
+	conn.Send("ZADD", p.key("trash"), now.Unix(), id)
+	conn.Send("INCR", p.generationKey())
+	if token != "" {
+		// The token is needed to undo the deletion, so it has to live as
+		// long as the entry is in the trash.
+		conn.Send("EXPIRE", p.key("deletetoken", token), int(cfg.Trash.Keep.Seconds()))
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		files := make(map[string]string)
+		for original, trashed := range trashFiles(id) {
+			files[trashed] = original
+		}
+		if moveErr := p.moveFiles(files); moveErr != nil {
+			log.Printf("Can not move files of entry %d back from the trash: %v", id, moveErr)
+		}
+		return xerrors.Errorf("can not move entry %d to trash: %w", id, err)
+	}
+	return nil
+}
+
+// restoreFromTrash moves an entry out of the trash.
+func (p *pool) restoreFromTrash(id int) error {
+	conn := p.Get()
+	defer conn.Close()
+
+	_, err := redis.Int64(conn.Do("ZSCORE", p.key("trash"), id))
+	if err == redis.ErrNil {
+		return errUnknownImage
+	}
+	if err != nil {
+		return xerrors.Errorf("can not receive trashed entry %d: %w", id, err)
+	}
+
+	created, err := p.entryCreated(id)
+	if err != nil {
+		return err
+	}
+
+	token, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "deletetoken"))
+	if err != nil && err != redis.ErrNil {
+		return xerrors.Errorf("can not receive delete token of entry %d: %w", id, err)
+	}
+
+	// Move the files first, so the entry is not shown without its mail
+	files := make(map[string]string)
+	for original, trashed := range trashFiles(id) {
+		files[trashed] = original
+	}
+	if err := p.moveFiles(files); err != nil {
+		return err
+	}
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", p.key("entry", strconv.Itoa(id)), "deleted")
+	conn.Send("ZADD", p.key("entries"), created.Unix(), id)
+	conn.Send("ZREM", p.key("trash"), id)
+	conn.Send("INCR", p.generationKey())
+	if token != "" {
+		// trashEntry extended the token for the undo link. It gets its
+		// normal expiry again, which deletes it, if it is already over.
+		conn.Send("EXPIREAT", p.key("deletetoken", token), created.Unix()+tokenExpire)
+	}
+	if _, err := conn.Do("EXEC"); err != nil {
+		return xerrors.Errorf("can not restore entry %d: %w", id, err)
+	}
+	return nil
+}
+
+// restoreFromToken restores an entry from the delete token that was used to
+// delete it. Returns the id of the entry.
+func (p *pool) restoreFromToken(token string) (int, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	id, err := redis.Int(conn.Do("GET", p.key("deletetoken", token)))
+	if err == redis.ErrNil {
+		return 0, errUnknownImage
+	}
+	if err != nil {
+		return 0, xerrors.Errorf("can not find id for token: %w", err)
+	}
+
+	return id, p.restoreFromTrash(id)
+}
+
+// trashedEntry is an entry in the trash.
+type trashedEntry struct {
+	ID      int       `json:"id"`
+	Subject string    `json:"subject"`
+	From    string    `json:"from"`
+	Deleted time.Time `json:"deleted"`
+	Purge   time.Time `json:"purge"`
+}
+
+// trashedEntries returns all entries in the trash, the oldest first.
+func (p *pool) trashedEntries() ([]trashedEntry, error) {
+	conn := p.Get()
+	defer conn.Close()
+
+	values, err := redis.Int64s(conn.Do("ZRANGE", p.key("trash"), 0, -1, "WITHSCORES"))
+	if err != nil {
+		return nil, xerrors.Errorf("can not receive trash: %w", err)
+	}
+
+	entries := make([]trashedEntry, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		id := int(values[i])
+		fields, err := redis.Strings(conn.Do("HMGET", p.key("entry", strconv.Itoa(id)), "subject", "from"))
+		if err != nil {
+			return nil, xerrors.Errorf("can not receive entry %d: %w", id, err)
+		}
+
+		deleted := time.Unix(values[i+1], 0)
+		entries = append(entries, trashedEntry{
+			ID:      id,
+			Subject: fields[0],
+			From:    fields[1],
+			Deleted: deleted,
+			Purge:   deleted.Add(cfg.Trash.Keep),
+		})
+	}
+	return entries, nil
+}
+
+// purgeTrash deletes all entries that are longer in the trash than the
+// configured time. If all is true, all entries in the trash are deleted.
+// Returns the number of deleted entries.
+func (p *pool) purgeTrash(now time.Time, all bool) (int, error) {
+	max := strconv.FormatInt(now.Add(-cfg.Trash.Keep).Unix(), 10)
+	if all {
+		max = "+inf"
+	}
+
+	conn := p.Get()
+	ids, err := redis.Ints(conn.Do("ZRANGEBYSCORE", p.key("trash"), "-inf", max))
+	conn.Close()
+	if err != nil {
+		return 0, xerrors.Errorf("can not receive trash: %w", err)
+	}
+
+	var purged int
+	for _, id := range ids {
+		if err := p.purgeEntry(id); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// purgeEntry deletes an entry from the trash.
+func (p *pool) purgeEntry(id int) error {
+	for _, trashed := range trashFiles(id) {
+		if err := p.store.remove(trashed); err != nil {
+			return xerrors.Errorf("can not delete %s: %w", trashed, err)
+		}
+	}
+
+	if err := p.deleteFromID(id); err != nil && err != errUnknownImage {
+		return err
+	}
+	return nil
+}
+
+// watchTrash deletes the entries that are too long in the trash. It never
+// returns.
+func watchTrash(p *pool) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := p.purgeTrash(time.Now(), false); err != nil {
+			log.Printf("Can not purge trash: %v", err)
+		}
+	}
+}
+
+// Restore moves an entry out of the trash.
+func Restore(id int) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	return pool.restoreFromTrash(id)
+}
+
+// Trash writes all entries in the trash to w.
+func Trash(w io.Writer) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	entries, err := pool.trashedEntries()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tDELETED\tPURGE\tFROM\tSUBJECT")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", e.ID, e.Deleted.Format("2006-01-02 15:04"), e.Purge.Format("2006-01-02 15:04"), e.From, e.Subject)
+	}
+	return tw.Flush()
+}
+
+// PurgeTrash deletes the entries that are longer in the trash than the
+// configured time. If all is true, the trash is emptied.
+func PurgeTrash(w io.Writer, all bool) error {
+	pool, err := newPool(cfg.Redis)
+	if err != nil {
+		return xerrors.Errorf("Can not create redis pool: %w", err)
+	}
+
+	purged, err := pool.purgeTrash(time.Now(), all)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d entries deleted\n", purged)
+	return nil
+}
@@ -0,0 +1,141 @@
+package mailimage
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// trashConfigTOML keeps deleted entries for a week.
+const trashConfigTOML = "[trash]\nkeep = \"168h\"\n"
+
+// insertTestEntry inserts a mail and returns its id.
+func insertTestEntry(t testing.TB, p *pool) int {
+	t.Helper()
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board, noReply: true})
+	if err != nil {
+		t.Fatalf("insert returned error: %v", err)
+	}
+	return result.id
+}
+
+func TestTrashKeepsDeleteToken(t *testing.T) {
+	p := setupTest(t, trashConfigTOML)
+	id := insertTestEntry(t, p)
+
+	conn := p.Get()
+	defer conn.Close()
+
+	token, err := redis.String(conn.Do("HGET", p.key("entry", strconv.Itoa(id)), "deletetoken"))
+	if err != nil {
+		t.Fatalf("can not receive delete token: %v", err)
+	}
+
+	if err := p.deleteFromToken(token); err != nil {
+		t.Fatalf("deleteFromToken returned error: %v", err)
+	}
+
+	ttl, err := redis.Int(conn.Do("TTL", p.key("deletetoken", token)))
+	if err != nil {
+		t.Fatalf("can not receive ttl of token: %v", err)
+	}
+	if keep := int(cfg.Trash.Keep.Seconds()); ttl < keep-60 {
+		t.Errorf("token expires in %d seconds, expected %d", ttl, keep)
+	}
+
+	if _, err := p.restoreFromToken(token); err != nil {
+		t.Fatalf("restoreFromToken returned error: %v", err)
+	}
+
+	ttl, err = redis.Int(conn.Do("TTL", p.key("deletetoken", token)))
+	if err != nil {
+		t.Fatalf("can not receive ttl of token: %v", err)
+	}
+	if ttl > tokenExpire || ttl < tokenExpire-60 {
+		t.Errorf("token expires in %d seconds after restore, expected %d", ttl, tokenExpire)
+	}
+}
+
+func TestRestoreRemovesExpiredToken(t *testing.T) {
+	p := setupTest(t, trashConfigTOML)
+	id := insertTestEntry(t, p)
+
+	conn := p.Get()
+	defer conn.Close()
+
+	entryKey := p.key("entry", strconv.Itoa(id))
+	token, err := redis.String(conn.Do("HGET", entryKey, "deletetoken"))
+	if err != nil {
+		t.Fatalf("can not receive delete token: %v", err)
+	}
+
+	// The entry is older than the normal token expiry.
+	created := time.Now().Add(-48 * time.Hour)
+	if _, err := conn.Do("HSET", entryKey, "created", formatTime(created)); err != nil {
+		t.Fatalf("can not change created time: %v", err)
+	}
+
+	if err := p.deleteFromToken(token); err != nil {
+		t.Fatalf("deleteFromToken returned error: %v", err)
+	}
+	if _, err := p.restoreFromToken(token); err != nil {
+		t.Fatalf("restoreFromToken returned error: %v", err)
+	}
+
+	exists, err := redis.Bool(conn.Do("EXISTS", p.key("deletetoken", token)))
+	if err != nil {
+		t.Fatalf("can not check token: %v", err)
+	}
+	if exists {
+		t.Errorf("delete token is still valid after restore")
+	}
+}
+
+func TestTrashMovesFilesBeforeRedis(t *testing.T) {
+	p := setupTest(t, trashConfigTOML)
+	id := insertTestEntry(t, p)
+
+	// A file with the name of the trash folder lets the move fail.
+	if err := p.store.write("trash", nil); err != nil {
+		t.Fatalf("can not block trash folder: %v", err)
+	}
+
+	if err := p.trashEntry(id); err == nil {
+		t.Fatalf("trashEntry returned no error")
+	}
+
+	if _, err := p.getEntry(id); err != nil {
+		t.Errorf("entry is not available after failed trash: %v", err)
+	}
+	trashed, err := p.trashedEntries()
+	if err != nil {
+		t.Fatalf("trashedEntries returned error: %v", err)
+	}
+	if len(trashed) != 0 {
+		t.Errorf("entry is in the trash: %v", trashed)
+	}
+	if _, err := p.store.stat("success/" + strconv.Itoa(id)); err != nil {
+		t.Errorf("mail is not in the success folder: %v", err)
+	}
+}
+
+func TestTrashedEntryIsNoDuplicate(t *testing.T) {
+	p := setupTest(t, trashConfigTOML+"[duplicates]\naction = \"reject\"\n")
+	id := insertTestEntry(t, p)
+
+	if err := p.trashEntry(id); err != nil {
+		t.Fatalf("trashEntry returned error: %v", err)
+	}
+
+	result, err := insert(bytes.NewReader(testMail(t, "user@example.org", "")), insertOptions{board: p.board, noReply: true})
+	if err != nil {
+		t.Fatalf("insert returned error: %v", err)
+	}
+	if result.folder != "success" || result.id == id {
+		t.Errorf("resent image is in folder %q with id %d, expected a new entry", result.folder, result.id)
+	}
+}
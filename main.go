@@ -29,6 +29,27 @@ func main() {
 	app.Usage = "An image bord where images are posted via mail"
 	app.Version = version
 
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config, c",
+			Value:  mailimage.DefaultConfigPath,
+			Usage:  "Path to the config file",
+			EnvVar: "MAILIMAGE_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "board, b",
+			Usage:  "Name of the board, required if more than one board is configured. Serve serves only this board",
+			EnvVar: "MAILIMAGE_BOARD",
+		},
+	}
+
+	app.Before = func(c *cli.Context) error {
+		if err := mailimage.LoadConfig(c.String("config")); err != nil {
+			return err
+		}
+		return mailimage.SelectBoard(c.String("board"))
+	}
+
 	app.Commands = []cli.Command{
 		{
 			Name:  "serve",
@@ -63,23 +84,133 @@ func main() {
 		{
 			Name:  "insert",
 			Usage: "Read an mail from stdin, parse it and save the image into te database",
+			Action: func(c *cli.Context) error {
+				return mailimage.Insert(os.Stdin)
+			},
+		},
+		{
+			Name:      "check",
+			Usage:     "validate a mail without saving it or sending a response",
+			ArgsUsage: "<file.eml>",
 			Flags: []cli.Flag{
 				cli.BoolFlag{
-					Name:   "debug, d",
-					Usage:  "debug mode where mails are printed to stdout",
-					EnvVar: "DEBUG",
+					Name:  "json",
+					Usage: "print the report as json",
 				},
 			},
 			Action: func(c *cli.Context) error {
-				if c.Bool("debug") {
-					os.Setenv("FOO", "1")
+				if !c.Args().Present() {
+					fmt.Printf("No file given\n")
+					os.Exit(1)
 				}
-				return mailimage.Insert(os.Stdin)
+
+				f, err := os.Open(c.Args().First())
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+
+				valid, err := mailimage.Check(os.Stdout, f, c.Bool("json"))
+				if err != nil {
+					return err
+				}
+
+				if !valid {
+					os.Exit(1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "fsck",
+			Usage: "check that redis and the files on disk match",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "repair",
+					Usage: "fix the problems that where found",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				left, err := mailimage.Fsck(os.Stdout, c.Bool("repair"))
+				if err != nil {
+					return err
+				}
+
+				if left > 0 {
+					os.Exit(1)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "migrate",
+			Usage: "upgrade the data in redis to the schema of this version",
+			Action: func(c *cli.Context) error {
+				return mailimage.Migrate(os.Stdout)
+			},
+		},
+		{
+			Name:  "expire",
+			Usage: "delete or archive expired images and notify their senders",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only show what would be done",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return mailimage.Expire(os.Stdout, c.Bool("dry-run"))
+			},
+		},
+		{
+			Name:  "recover",
+			Usage: "complete or roll back inserts that where interrupted",
+			Action: func(c *cli.Context) error {
+				return mailimage.Recover(os.Stdout)
+			},
+		},
+		{
+			Name:      "reprocess",
+			Usage:     "insert mails from the error or invalid folder again",
+			ArgsUsage: "[file...]",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "folder",
+					Value: "error",
+					Usage: "folder with the mails, error or invalid",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only reprocess mails received after this date (YYYY-MM-DD)",
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only show the mails that would be reprocessed",
+				},
+				cli.BoolFlag{
+					Name:  "no-reply",
+					Usage: "do not send responses to the senders",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return mailimage.Reprocess(os.Stdout, mailimage.ReprocessOptions{
+					Folder:  c.String("folder"),
+					Since:   parseDate(c.String("since")),
+					Files:   c.Args(),
+					DryRun:  c.Bool("dry-run"),
+					NoReply: c.Bool("no-reply"),
+				})
 			},
 		},
 		{
 			Name:  "delete",
-			Usage: "delete an image by id from the database",
+			Usage: "move an image by id into the trash",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "permanent",
+					Usage: "delete the image immediately instead of moving it into the trash",
+				},
+			},
 			Action: func(c *cli.Context) error {
 				idS := c.Args().First()
 				if idS == "" {
@@ -93,7 +224,299 @@ func main() {
 					os.Exit(1)
 				}
 
-				return mailimage.Delete(id)
+				return mailimage.Delete(id, c.Bool("permanent"))
+			},
+		},
+		{
+			Name:      "restore",
+			Usage:     "restore an image from the trash",
+			ArgsUsage: "<id>",
+			Action: func(c *cli.Context) error {
+				id, err := strconv.Atoi(c.Args().First())
+				if err != nil {
+					fmt.Printf("Id has to be a number\n")
+					os.Exit(1)
+				}
+
+				return mailimage.Restore(id)
+			},
+		},
+		{
+			Name:  "trash",
+			Usage: "show the images in the trash",
+			Action: func(c *cli.Context) error {
+				return mailimage.Trash(os.Stdout)
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "purge",
+					Usage: "delete the images that are longer in the trash than configured",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "all",
+							Usage: "delete all images in the trash",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return mailimage.PurgeTrash(os.Stdout, c.Bool("all"))
+					},
+				},
+			},
+		},
+		{
+			Name:  "list",
+			Usage: "list the images in the database",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "only images from senders whose name or address contains this text",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "only images posted at or after this date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "only images posted before this date (YYYY-MM-DD)",
+				},
+				cli.StringFlag{
+					Name:  "search",
+					Usage: "only images whose subject or text contains this text",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "table",
+					Usage: "output format: table, json or csv",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return mailimage.List(os.Stdout, mailimage.ListOptions{
+					From:   c.String("from"),
+					Since:  parseDate(c.String("since")),
+					Until:  parseDate(c.String("until")),
+					Search: c.String("search"),
+					Format: c.String("format"),
+				})
+			},
+		},
+		{
+			Name:      "show",
+			Usage:     "show all stored data of an image",
+			ArgsUsage: "<id>",
+			Action: func(c *cli.Context) error {
+				id, err := strconv.Atoi(c.Args().First())
+				if err != nil {
+					fmt.Printf("Id has to be a number\n")
+					os.Exit(1)
+				}
+
+				return mailimage.Show(os.Stdout, id)
+			},
+		},
+		{
+			Name:      "edit",
+			Usage:     "change the subject, the text or the sender name of an image",
+			ArgsUsage: "<id>",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "subject",
+					Usage: "new subject",
+				},
+				cli.StringFlag{
+					Name:  "text",
+					Usage: "new text",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "new sender name",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				id, err := strconv.Atoi(c.Args().First())
+				if err != nil {
+					fmt.Printf("Id has to be a number\n")
+					os.Exit(1)
+				}
+
+				var u mailimage.EntryUpdate
+				for name, field := range map[string]**string{"subject": &u.Subject, "text": &u.Text, "from": &u.From} {
+					if c.IsSet(name) {
+						value := c.String(name)
+						*field = &value
+					}
+				}
+				return mailimage.UpdateEntry(id, u)
+			},
+		},
+		{
+			Name:      "export",
+			Usage:     "write all images with their data and mails into an archive",
+			ArgsUsage: "<archive.tar.gz>",
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					fmt.Printf("No archive given\n")
+					os.Exit(1)
+				}
+				return mailimage.Export(os.Stdout, c.Args().First())
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "restore the images from an archive that was written by export",
+			ArgsUsage: "<archive.tar.gz>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "preserve-ids",
+					Usage: "keep the ids of the images instead of creating new ones",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if !c.Args().Present() {
+					fmt.Printf("No archive given\n")
+					os.Exit(1)
+				}
+				return mailimage.Import(os.Stdout, c.Args().First(), c.Bool("preserve-ids"))
+			},
+		},
+		{
+			Name:  "dedupe",
+			Usage: "report similar images in the database",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "distance",
+					Value: 4,
+					Usage: "maximum number of different bits between two image hashes",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return mailimage.Dedupe(os.Stdout, c.Int("distance"))
+			},
+		},
+		{
+			Name:  "sender",
+			Usage: "manage the rules which senders are allowed to post images",
+			Subcommands: []cli.Command{
+				{
+					Name:      "allow",
+					Usage:     "allow an address or a domain (starting with @) to post images",
+					ArgsUsage: "<address|@domain>...",
+					Action: func(c *cli.Context) error {
+						if !c.Args().Present() {
+							fmt.Printf("No address given\n")
+							os.Exit(1)
+						}
+						return mailimage.SenderAllow(c.Args()...)
+					},
+				},
+				{
+					Name:      "block",
+					Usage:     "block an address or a pattern like *@example.com",
+					ArgsUsage: "<address|pattern>...",
+					Action: func(c *cli.Context) error {
+						if !c.Args().Present() {
+							fmt.Printf("No address given\n")
+							os.Exit(1)
+						}
+						return mailimage.SenderBlock(c.Args()...)
+					},
+				},
+				{
+					Name:      "exempt",
+					Usage:     "exclude an address from the post limits",
+					ArgsUsage: "<address>...",
+					Action: func(c *cli.Context) error {
+						if !c.Args().Present() {
+							fmt.Printf("No address given\n")
+							os.Exit(1)
+						}
+						return mailimage.SenderExempt(c.Args()...)
+					},
+				},
+				{
+					Name:      "remove",
+					Usage:     "remove an allow, block or exempt rule",
+					ArgsUsage: "<rule>...",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "list",
+							Usage: "only remove the rule from this list: allow, allow_domains, block, block_patterns or exempt",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						if !c.Args().Present() {
+							fmt.Printf("No rule given\n")
+							os.Exit(1)
+						}
+						return mailimage.SenderRemove(os.Stdout, c.String("list"), c.Args()...)
+					},
+				},
+				{
+					Name:  "list",
+					Usage: "list all sender rules",
+					Action: func(c *cli.Context) error {
+						return mailimage.SenderList(os.Stdout)
+					},
+				},
+			},
+		},
+		{
+			Name:  "blobs",
+			Usage: "show statistics about the blob store of the images",
+			Action: func(c *cli.Context) error {
+				return mailimage.Blobs(os.Stdout)
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "migrate",
+					Usage: "move the images from the folders images and thumbnail into the blob store",
+					Action: func(c *cli.Context) error {
+						return mailimage.MigrateBlobs(os.Stdout)
+					},
+				},
+			},
+		},
+		{
+			Name:  "mailq",
+			Usage: "show the queue of outgoing mails",
+			Action: func(c *cli.Context) error {
+				return mailimage.MailQueue(os.Stdout)
+			},
+			Subcommands: []cli.Command{
+				{
+					Name:  "flush",
+					Usage: "try to deliver all queued mails now",
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "dead",
+							Usage: "also retry the dead letters",
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return mailimage.FlushMailQueue(os.Stdout, c.Bool("dead"))
+					},
+				},
+				{
+					Name:      "delete",
+					Usage:     "remove mails from the queue",
+					ArgsUsage: "<id>...",
+					Action: func(c *cli.Context) error {
+						if !c.Args().Present() {
+							fmt.Printf("No id given\n")
+							os.Exit(1)
+						}
+
+						ids := make([]int, len(c.Args()))
+						for i, arg := range c.Args() {
+							id, err := strconv.Atoi(arg)
+							if err != nil {
+								fmt.Printf("Id has to be a number\n")
+								os.Exit(1)
+							}
+							ids[i] = id
+						}
+						return mailimage.DeleteQueuedMail(ids...)
+					},
+				},
 			},
 		},
 	}
@@ -103,3 +526,18 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// parseDate parses a date given as command line argument. An empty value
+// returns the zero time.
+func parseDate(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	date, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		fmt.Printf("Invalid date %s, use the format YYYY-MM-DD\n", value)
+		os.Exit(1)
+	}
+	return date
+}